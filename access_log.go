@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestIDHeader — идентификатор запроса. Берется из запроса клиента или
+// создается, возвращается клиенту в ответе и пишется в журнал запросов.
+const RequestIDHeader = "X-Request-Id"
+
+// Параметры журнала запросов
+const (
+	accessLogStdout        = "-"         // Значение access_log для вывода в stdout
+	accessLogFlushInterval = time.Second // Период сброса буфера журнала в файл
+	accessLogBufferSize    = 64 * 1024   // Размер буфера записи
+	accessLogMaxError      = 256         // Сколько байт сообщения об ошибке сохраняется
+	accessLogFileMode      = os.FileMode(0644)
+)
+
+// accessLogEntry — строка журнала запросов (JSON Lines)
+type accessLogEntry struct {
+	Time           time.Time `json:"ts"`
+	RequestID      string    `json:"request_id"`
+	ClientAddr     string    `json:"client_addr"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	Query          string    `json:"query,omitempty"`
+	Endpoint       string    `json:"endpoint,omitempty"`
+	Group          string    `json:"group,omitempty"`
+	RPCMethod      string    `json:"rpc_method,omitempty"`
+	RPCID          string    `json:"rpc_id,omitempty"`
+	Proxy          string    `json:"proxy,omitempty"`
+	Status         int       `json:"status"`
+	UpstreamStatus int       `json:"upstream_status,omitempty"`
+	BytesIn        int64     `json:"bytes_in"`
+	BytesOut       int64     `json:"bytes_out"`
+	QueueWaitMs    float64   `json:"queue_wait_ms"`
+	UpstreamMs     float64   `json:"upstream_ms,omitempty"`
+	DurationMs     float64   `json:"duration_ms"`
+	Error          string    `json:"error,omitempty"`
+	Body           string    `json:"body,omitempty"`           // Начало тела запроса (access_log_body_max)
+	BodyTruncated  bool      `json:"body_truncated,omitempty"` // Тело длиннее сохраненной части
+
+	body *countingBody // Тело запроса, из которого берется Body
+}
+
+// accessLogKey — ключ записи журнала в контексте запроса
+type accessLogKey struct{}
+
+// accessEntryFrom возвращает запись журнала для запроса или nil, если
+// журнал отключен. Методы записи допускают nil.
+func accessEntryFrom(ctx context.Context) *accessLogEntry {
+	entry, _ := ctx.Value(accessLogKey{}).(*accessLogEntry)
+	return entry
+}
+
+// setRPC запоминает метод и идентификатор JSON-RPC запроса
+func (e *accessLogEntry) setRPC(call *rpcCall) {
+	if e == nil || call == nil {
+		return
+	}
+	e.RPCMethod = call.Method
+	e.RPCID = call.ID
+}
+
+// setUpstream запоминает итог запроса к эндпоинту: прокси, статус ответа,
+// задержку и ошибку
+func (e *accessLogEntry) setUpstream(endpoint string, proxy *Proxy, resp *http.Response, latency time.Duration, err error) {
+	if e == nil {
+		return
+	}
+	e.Endpoint = endpoint
+	if proxy != nil {
+		e.Proxy = proxy.MaskedURL()
+	}
+	if resp != nil {
+		e.UpstreamStatus = resp.StatusCode
+	}
+	e.UpstreamMs = durationMs(latency)
+	if err != nil {
+		e.setError(err.Error())
+	}
+}
+
+// setError запоминает сообщение об ошибке
+func (e *accessLogEntry) setError(message string) {
+	if e == nil {
+		return
+	}
+	message = strings.TrimSpace(message)
+	if len(message) > accessLogMaxError {
+		message = message[:accessLogMaxError]
+	}
+	e.Error = message
+}
+
+// addTunnelBytes учитывает трафик CONNECT-туннеля
+func (e *accessLogEntry) addTunnelBytes(in, out int64) {
+	if e == nil {
+		return
+	}
+	atomic.AddInt64(&e.BytesIn, in)
+	atomic.AddInt64(&e.BytesOut, out)
+}
+
+// durationMs переводит длительность в миллисекунды с точностью до микросекунды
+func durationMs(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
+// MaskedURL возвращает адрес прокси для журналов: пароль скрыт
+func (p *Proxy) MaskedURL() string {
+	if p.User == "" {
+		return fmt.Sprintf("%s://%s:%d", p.Scheme, p.Host, p.Port)
+	}
+	return fmt.Sprintf("%s://%s:***@%s:%d", p.Scheme, p.User, p.Host, p.Port)
+}
+
+// newRequestID создает случайный идентификатор запроса
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// accessWriter запоминает статус и размер ответа клиенту. Текст ответа
+// с ошибкой, сформированного самим сервером, сохраняется в записи журнала.
+type accessWriter struct {
+	http.ResponseWriter
+	entry       *accessLogEntry
+	wroteHeader bool
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.entry.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.entry.Status >= 400 && w.entry.UpstreamStatus == 0 && w.entry.Error == "" {
+		w.entry.setError(string(b))
+	}
+	n, err := w.ResponseWriter.Write(b)
+	atomic.AddInt64(&w.entry.BytesOut, int64(n))
+	return n, err
+}
+
+// Hijack передает соединение обработчику CONNECT
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Hijacking не поддерживается")
+	}
+	w.wroteHeader = true
+	w.entry.Status = http.StatusOK
+	return hijacker.Hijack()
+}
+
+// Flush передает клиенту буферизованные данные
+func (w *accessWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// countingBody учитывает прочитанные байты тела запроса и сохраняет
+// не больше captureMax первых байт для журнала
+type countingBody struct {
+	io.ReadCloser
+	entry      *accessLogEntry
+	captureMax int
+
+	mu      sync.Mutex // Тело может дочитываться транспортом после ответа
+	capture bytes.Buffer
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.entry.BytesIn, int64(n))
+	if b.captureMax > 0 && n > 0 {
+		b.mu.Lock()
+		if room := b.captureMax - b.capture.Len(); room > 0 {
+			if room > n {
+				room = n
+			}
+			b.capture.Write(p[:room])
+		}
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+// captured возвращает сохраненное начало тела и признак того, что тело
+// длиннее сохраненной части или прочитано не полностью
+func (b *countingBody) captured() (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.capture.String(), atomic.LoadInt64(&b.entry.BytesIn) > int64(b.capture.Len())
+}
+
+// AccessLogger пишет журнал запросов в формате JSON Lines с ротацией по
+// размеру. Строки буферизуются и сбрасываются в файл раз в секунду.
+type AccessLogger struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	writer     *bufio.Writer
+	size       int64   // Размер текущего файла
+	maxSize    int64   // Размер для ротации, 0 — без ротации
+	maxBackups int     // Сколько прежних файлов хранить
+	sampleRate float64 // Доля успешных запросов, попадающих в журнал
+	bodyMax    int     // Сколько байт тела запроса сохранять, 0 — не сохранять
+}
+
+// NewAccessLogger открывает журнал запросов по настройкам конфигурации.
+// Возвращает nil, если журнал отключен.
+func NewAccessLogger(config *Config) (*AccessLogger, error) {
+	if config.AccessLog == "" {
+		return nil, nil
+	}
+
+	al := &AccessLogger{
+		path:       config.AccessLog,
+		maxBackups: config.AccessLogMaxBackups,
+		sampleRate: config.AccessLogSampleRate,
+		bodyMax:    config.AccessLogBodyMax,
+	}
+	if config.AccessLogMaxSizeMB > 0 {
+		al.maxSize = int64(config.AccessLogMaxSizeMB) * 1024 * 1024
+	}
+	if al.maxBackups < 0 {
+		al.maxBackups = 0
+	}
+	if al.bodyMax < 0 {
+		al.bodyMax = 0
+	}
+
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	go al.flushLoop()
+	return al, nil
+}
+
+// open открывает файл журнала для дозаписи. Вызывается под al.mu.
+func (al *AccessLogger) open() error {
+	if al.path == accessLogStdout {
+		al.file = os.Stdout
+		al.writer = bufio.NewWriterSize(os.Stdout, accessLogBufferSize)
+		return nil
+	}
+
+	file, err := os.OpenFile(al.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, accessLogFileMode)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	al.file = file
+	al.size = info.Size()
+	al.writer = bufio.NewWriterSize(file, accessLogBufferSize)
+	return nil
+}
+
+// flushLoop периодически сбрасывает буфер журнала в файл
+func (al *AccessLogger) flushLoop() {
+	ticker := time.NewTicker(accessLogFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		al.mu.Lock()
+		if al.writer != nil {
+			al.writer.Flush()
+		}
+		al.mu.Unlock()
+	}
+}
+
+// sampled сообщает, попадает ли запрос в журнал. Запросы с ошибкой
+// записываются всегда.
+func (al *AccessLogger) sampled(entry *accessLogEntry) bool {
+	if al.sampleRate >= 1 || entry.Error != "" || entry.Status >= 500 {
+		return true
+	}
+	return mathrand.Float64() < al.sampleRate
+}
+
+// Log записывает строку журнала
+func (al *AccessLogger) Log(entry *accessLogEntry) {
+	if !al.sampled(entry) {
+		return
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(entry); err != nil {
+		log.Printf("Ошибка записи журнала запросов: %v", err)
+		return
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.writer == nil {
+		return
+	}
+	if al.maxSize > 0 && al.file != os.Stdout && al.size+int64(buf.Len()) > al.maxSize && al.size > 0 {
+		if err := al.rotate(); err != nil {
+			log.Printf("Ошибка ротации журнала запросов: %v", err)
+			if al.writer == nil {
+				return
+			}
+		}
+	}
+	n, _ := al.writer.Write(buf.Bytes())
+	al.size += int64(n)
+}
+
+// rotate переименовывает текущий файл в <path>.1, сдвигая прежние копии,
+// и открывает новый. Копии сверх access_log_max_backups удаляются.
+// Вызывается под al.mu.
+func (al *AccessLogger) rotate() error {
+	al.writer.Flush()
+	al.file.Close()
+	al.writer = nil
+
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", al.path, i) }
+	if al.maxBackups == 0 {
+		os.Remove(al.path)
+	} else {
+		os.Remove(backup(al.maxBackups))
+		for i := al.maxBackups - 1; i >= 1; i-- {
+			os.Rename(backup(i), backup(i+1))
+		}
+		if err := os.Rename(al.path, backup(1)); err != nil && !os.IsNotExist(err) {
+			al.open()
+			return err
+		}
+	}
+	return al.open()
+}
+
+// Close сбрасывает буфер и закрывает файл журнала
+func (al *AccessLogger) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.writer == nil {
+		return nil
+	}
+	err := al.writer.Flush()
+	if al.file != os.Stdout {
+		if closeErr := al.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	al.writer = nil
+	return err
+}
+
+// startAccessEntry создает запись журнала для запроса и подменяет writer и
+// тело запроса для учета статуса и трафика. Если журнал отключен, возвращает
+// исходные значения и nil.
+func (ps *ProxyServer) startAccessEntry(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, *accessLogEntry) {
+	if ps.accessLog == nil {
+		return w, r, nil
+	}
+
+	requestID := r.Header.Get(RequestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, requestID)
+
+	entry := &accessLogEntry{
+		Time:       time.Now(),
+		RequestID:  requestID,
+		ClientAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+	}
+	if r.Method == http.MethodConnect {
+		entry.Path = r.Host
+	}
+	// Строка запроса может содержать ключи доступа, поэтому сохраняется
+	// только вместе с телом, по access_log_body_max
+	if ps.accessLog.bodyMax > 0 {
+		entry.Query = r.URL.RawQuery
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		body := &countingBody{ReadCloser: r.Body, entry: entry, captureMax: ps.accessLog.bodyMax}
+		entry.body = body
+		r.Body = body
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry))
+	return &accessWriter{ResponseWriter: w, entry: entry}, r, entry
+}
+
+// finishAccessEntry дописывает длительность запроса и отправляет запись в журнал
+func (ps *ProxyServer) finishAccessEntry(entry *accessLogEntry) {
+	if entry == nil {
+		return
+	}
+	entry.DurationMs = durationMs(time.Since(entry.Time))
+	if entry.body != nil && entry.body.captureMax > 0 {
+		entry.Body, entry.BodyTruncated = entry.body.captured()
+	}
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	ps.accessLog.Log(entry)
+}
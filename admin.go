@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// adminMaxBody — максимальный размер тела запроса к /admin/proxies
+const adminMaxBody = 64 * 1024
+
+// Ошибки изменения списка прокси через /admin/proxies
+var (
+	errInvalidProxy  = errors.New("некорректная запись прокси")
+	errProxyExists   = errors.New("прокси уже есть в списке")
+	errProxyNotFound = errors.New("прокси не найден")
+	errLastProxy     = errors.New("нельзя удалить последний прокси")
+)
+
+// proxyUpdate — изменения прокси в запросе PATCH /admin/proxies?id=...
+// Не указанные поля остаются прежними.
+type proxyUpdate struct {
+	Disabled      *bool     `json:"disabled"`
+	Weight        *float64  `json:"weight"`
+	Tags          *[]string `json:"tags"`
+	ResetCounters bool      `json:"reset_counters"` // Обнулить счетчики, задержку и автомат защиты
+}
+
+// toJSON возвращает запись прокси в формате файла списка
+func (p *Proxy) toJSON() ProxyJSON {
+	weight := p.Weight
+	return ProxyJSON{
+		Host:          p.Host,
+		Port:          p.Port,
+		User:          p.User,
+		Pass:          p.Pass,
+		Weight:        &weight,
+		Scheme:        p.Scheme,
+		Tags:          p.Tags,
+		Disabled:      p.Disabled(),
+		TLSServerName: p.TLSServerName,
+		CAFile:        p.CAFile,
+		CertFile:      p.CertFile,
+		KeyFile:       p.KeyFile,
+	}
+}
+
+// resetCounters обнуляет накопленную статистику прокси. Выполняющиеся
+// запросы и открытые туннели продолжают учитываться.
+func (p *Proxy) resetCounters() {
+	atomic.StoreInt64(&p.ErrorCount, 0)
+	atomic.StoreInt64(&p.UsageCount, 0)
+	atomic.StoreInt64(&p.RetryCount, 0)
+	atomic.StoreInt64(&p.lastUsed, 0)
+	atomic.StoreUint64(&p.latencyBits, 0)
+	p.breaker.Reset()
+	p.latency.Reset()
+	p.stats.reset()
+}
+
+// findProxy возвращает прокси по идентификатору host:port:user.
+// Вызывается под pm.mu.
+func (pm *ProxyManager) findProxy(id string) (int, *Proxy) {
+	for i, p := range pm.proxies {
+		if p.Key() == id {
+			return i, p
+		}
+	}
+	return -1, nil
+}
+
+// persistProxies записывает список прокси в proxies_file, если включено
+// admin_persist. Вызывается под pm.mu до применения изменений, чтобы при
+// ошибке записи список в памяти и файл не расходились.
+func (pm *ProxyManager) persistProxies(entries []ProxyJSON) error {
+	if !pm.config.AdminPersist {
+		return nil
+	}
+
+	data, err := formatProxyList(entries, pm.persistFormat)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(pm.config.ProxiesFile, data); err != nil {
+		return fmt.Errorf("ошибка сохранения списка прокси: %v", err)
+	}
+	return nil
+}
+
+// proxiesPersistFormat определяет формат, в котором admin_persist будет
+// записывать proxies_file. Текстовый и CSV-форматы не сохраняются: при
+// записи потерялись бы комментарии и поля, которых в них нет.
+func proxiesPersistFormat(config *Config) (string, error) {
+	filename, format := config.ProxiesFile, config.ProxiesFormat
+	if format == "" || format == ProxiesFormatAuto {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		format = detectProxiesFormat(filename, data)
+	}
+
+	if format != ProxiesFormatJSON && format != ProxiesFormatJSONL {
+		return "", fmt.Errorf("admin_persist: %s в формате %s не может быть сохранен, используйте json или jsonl либо отключите admin_persist",
+			filename, format)
+	}
+	return format, nil
+}
+
+// writeFileAtomic записывает файл через временный файл в том же каталоге
+// и переименование, сохраняя права доступа прежнего файла
+func writeFileAtomic(filename string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// proxyEntries возвращает записи текущего списка для сохранения в файл.
+// Вызывается под pm.mu.
+func (pm *ProxyManager) proxyEntries() []ProxyJSON {
+	entries := make([]ProxyJSON, 0, len(pm.proxies)+1)
+	for _, p := range pm.proxies {
+		entries = append(entries, p.toJSON())
+	}
+	return entries
+}
+
+// AddProxy добавляет прокси в список без перезагрузки файла
+func (pm *ProxyManager) AddProxy(pjson ProxyJSON) (*Proxy, error) {
+	p, err := newProxyFromJSON(pjson, newProxyTLSLoader(pm.config.ProxyCAFile))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidProxy, err)
+	}
+	p.breaker = newCircuitBreaker(pm.config)
+	p.latency = newLatencyRecorder()
+	p.stats = newProxyStats()
+
+	pm.reloadMu.Lock()
+	defer pm.reloadMu.Unlock()
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if _, existing := pm.findProxy(p.Key()); existing != nil {
+		return nil, errProxyExists
+	}
+	if err := pm.persistProxies(append(pm.proxyEntries(), p.toJSON())); err != nil {
+		return nil, err
+	}
+
+	pm.proxies = append(pm.proxies, p)
+	pm.byURL[p.URL] = p
+	pm.rebuildPool()
+
+	log.Printf("Прокси %s:%d добавлен, всего %d", p.Host, p.Port, len(pm.proxies))
+	return p, nil
+}
+
+// RemoveProxy удаляет прокси из списка. Прокси сразу перестает выдаваться
+// и освобождается после завершения запросов, как при перезагрузке списка.
+func (pm *ProxyManager) RemoveProxy(id string) (*Proxy, error) {
+	pm.reloadMu.Lock()
+	defer pm.reloadMu.Unlock()
+	pm.mu.Lock()
+
+	i, p := pm.findProxy(id)
+	if p == nil {
+		pm.mu.Unlock()
+		return nil, errProxyNotFound
+	}
+	if len(pm.proxies) == 1 {
+		pm.mu.Unlock()
+		return nil, errLastProxy
+	}
+
+	next := make([]*Proxy, 0, len(pm.proxies)-1)
+	next = append(next, pm.proxies[:i]...)
+	next = append(next, pm.proxies[i+1:]...)
+	entries := make([]ProxyJSON, 0, len(next))
+	for _, other := range next {
+		entries = append(entries, other.toJSON())
+	}
+	if err := pm.persistProxies(entries); err != nil {
+		pm.mu.Unlock()
+		return nil, err
+	}
+
+	pm.proxies = next
+	delete(pm.byURL, p.URL)
+	pm.rebuildPool()
+	pm.mu.Unlock()
+
+	go pm.drainProxy(p)
+
+	log.Printf("Прокси %s:%d удален, выполняется запросов: %d", p.Host, p.Port, atomic.LoadInt64(&p.ActiveConns))
+	return p, nil
+}
+
+// UpdateProxy отключает или включает прокси, меняет его вес и метки
+// и при необходимости обнуляет статистику
+func (pm *ProxyManager) UpdateProxy(id string, update proxyUpdate) (*Proxy, error) {
+	if update.Weight != nil && *update.Weight <= 0 {
+		return nil, fmt.Errorf("%w: вес должен быть положительным, для исключения прокси используйте disabled", errInvalidProxy)
+	}
+
+	pm.reloadMu.Lock()
+	defer pm.reloadMu.Unlock()
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	i, p := pm.findProxy(id)
+	if p == nil {
+		return nil, errProxyNotFound
+	}
+
+	pjson := p.toJSON()
+	if update.Disabled != nil {
+		pjson.Disabled = *update.Disabled
+	}
+	if update.Weight != nil {
+		pjson.Weight = update.Weight
+	}
+	if update.Tags != nil {
+		pjson.Tags = *update.Tags
+	}
+	if update.Disabled != nil || update.Weight != nil || update.Tags != nil {
+		entries := pm.proxyEntries()
+		entries[i] = pjson
+		if err := pm.persistProxies(entries); err != nil {
+			return nil, err
+		}
+	}
+
+	p.Tags = pjson.Tags
+	if update.Disabled != nil {
+		p.setDisabled(pjson.Disabled)
+	}
+	if update.Weight != nil && p.Weight != *update.Weight {
+		p.Weight = *update.Weight
+		pm.rebuildPool()
+	}
+	if update.ResetCounters {
+		p.resetCounters()
+	}
+
+	log.Printf("Прокси %s:%d изменен: вес %g, отключен %v, метки %v", p.Host, p.Port, p.Weight, p.Disabled(), p.Tags)
+	return p, nil
+}
+
+// adminAuth пропускает запрос только с заголовком Authorization: Bearer <token>
+func adminAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminProxies изменяет список прокси:
+//
+//	POST   /admin/proxies          — добавить прокси (тело — запись ProxyJSON)
+//	DELETE /admin/proxies?id=...   — удалить прокси с ожиданием его запросов
+//	PATCH  /admin/proxies?id=...   — изменить прокси (тело — proxyUpdate)
+//
+// id — идентификатор host:port:user из /proxies.
+func (pm *ProxyManager) handleAdminProxies(w http.ResponseWriter, r *http.Request) {
+	var (
+		p      *Proxy
+		err    error
+		status = http.StatusOK
+	)
+
+	switch r.Method {
+	case http.MethodPost:
+		var pjson ProxyJSON
+		if err := decodeAdminBody(w, r, &pjson); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p, err = pm.AddProxy(pjson)
+		status = http.StatusCreated
+	case http.MethodDelete:
+		p, err = pm.RemoveProxy(r.URL.Query().Get("id"))
+	case http.MethodPatch:
+		var update proxyUpdate
+		if err := decodeAdminBody(w, r, &update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p, err = pm.UpdateProxy(r.URL.Query().Get("id"), update)
+	default:
+		w.Header().Set("Allow", "POST, DELETE, PATCH")
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), adminErrorStatus(err))
+		return
+	}
+
+	pm.mu.RLock()
+	entry := proxyStatsEntry(p, time.Now())
+	pm.mu.RUnlock()
+	if r.Method == http.MethodDelete {
+		entry["removed"] = true
+	}
+	jsonData, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Ошибка сериализации данных прокси: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonData)
+}
+
+// decodeAdminBody разбирает JSON-тело запроса, отклоняя неизвестные поля
+func decodeAdminBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("Некорректное тело запроса: %v", err)
+	}
+	return nil
+}
+
+// adminErrorStatus возвращает HTTP-статус для ошибки изменения списка прокси
+func adminErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidProxy):
+		return http.StatusBadRequest
+	case errors.Is(err, errProxyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errProxyExists), errors.Is(err, errLastProxy):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminPersistFormat(t *testing.T) {
+	for _, tc := range []struct {
+		filename, format, data string
+		ok                     bool
+	}{
+		{"proxies.json", "auto", `[{"host":"10.0.0.1","port":1080}]`, true},
+		{"proxies.jsonl", "auto", `{"host":"10.0.0.1","port":1080}`, true},
+		{"proxies.list", "jsonl", `{"host":"10.0.0.1","port":1080}`, true},
+		{"proxies.txt", "auto", "10.0.0.1:1080\n", false},
+		{"proxies.csv", "auto", "10.0.0.1,1080\n", false},
+		{"proxies.list", "text", "10.0.0.1:1080\n", false},
+	} {
+		config := newTestConfig(t, map[string]interface{}{"admin_persist": true, "proxies_format": tc.format}, "")
+		config.ProxiesFile = filepath.Join(t.TempDir(), tc.filename)
+		if err := ioutil.WriteFile(config.ProxiesFile, []byte(tc.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		pm, err := NewProxyManager(config)
+		if !tc.ok {
+			if err == nil || !strings.HasPrefix(err.Error(), "admin_persist:") {
+				t.Errorf("%s (%s): запуск с admin_persist, ошибка %v", tc.filename, tc.format, err)
+			}
+			// Без admin_persist файл в этом формате загружается
+			config.AdminPersist = false
+			if _, err := NewProxyManager(config); err != nil {
+				t.Errorf("%s (%s): %v", tc.filename, tc.format, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s (%s): %v", tc.filename, tc.format, err)
+		}
+
+		// Изменение сохраняется в формате, определенном при запуске
+		if _, err := pm.AddProxy(ProxyJSON{Host: "10.0.0.2", Port: 1080}); err != nil {
+			t.Fatalf("%s: %v", tc.filename, err)
+		}
+		data, err := ioutil.ReadFile(config.ProxiesFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := parseProxyList(data, pm.persistFormat)
+		if err != nil || len(entries) != 2 || entries[1].Host != "10.0.0.2" {
+			t.Fatalf("%s: сохранено %q, ошибка %v", tc.filename, data, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import "math/rand"
+
+// aliasTable реализует выборку по весам методом псевдонимов (Vose).
+// Построение занимает O(n), каждая выборка — O(1).
+type aliasTable struct {
+	prob  []float64 // Вероятность остаться в своей ячейке
+	alias []int     // Ячейка-псевдоним для остатка вероятности
+}
+
+// newAliasTable строит таблицу по списку неотрицательных весов
+func newAliasTable(weights []float64) *aliasTable {
+	n := len(weights)
+	t := &aliasTable{
+		prob:  make([]float64, n),
+		alias: make([]int, n),
+	}
+	if n == 0 {
+		return t
+	}
+
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+
+	// Нормируем веса так, чтобы средний вес был равен 1
+	scaled := make([]float64, n)
+	small := make([]int, 0, n)
+	large := make([]int, 0, n)
+	for i, w := range weights {
+		if total > 0 {
+			scaled[i] = w * float64(n) / total
+		} else {
+			scaled[i] = 1
+		}
+		if scaled[i] < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+
+	for len(small) > 0 && len(large) > 0 {
+		s := small[len(small)-1]
+		small = small[:len(small)-1]
+		l := large[len(large)-1]
+		large = large[:len(large)-1]
+
+		t.prob[s] = scaled[s]
+		t.alias[s] = l
+
+		scaled[l] = scaled[l] + scaled[s] - 1
+		if scaled[l] < 1 {
+			small = append(small, l)
+		} else {
+			large = append(large, l)
+		}
+	}
+
+	// Остатки из-за погрешности вычислений получают вероятность 1
+	for _, i := range large {
+		t.prob[i] = 1
+	}
+	for _, i := range small {
+		t.prob[i] = 1
+	}
+
+	return t
+}
+
+// Sample возвращает индекс, выбранный пропорционально весу
+func (t *aliasTable) Sample() int {
+	i := rand.Intn(len(t.prob))
+	if rand.Float64() < t.prob[i] {
+		return i
+	}
+	return t.alias[i]
+}
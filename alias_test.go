@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// sampleShares возвращает доли выборок table по индексам
+func sampleShares(table *aliasTable, n, samples int) []float64 {
+	counts := make([]int, n)
+	for i := 0; i < samples; i++ {
+		counts[table.Sample()]++
+	}
+	shares := make([]float64, n)
+	for i, c := range counts {
+		shares[i] = float64(c) / float64(samples)
+	}
+	return shares
+}
+
+func TestAliasTableFollowsWeights(t *testing.T) {
+	for _, weights := range [][]float64{
+		{1},
+		{1, 1, 1, 1},
+		{1, 2, 3, 4},
+		{0.1, 10, 0, 5, 0.5},
+		{1000, 1, 1},
+	} {
+		var total float64
+		for _, w := range weights {
+			total += w
+		}
+
+		table := newAliasTable(weights)
+		shares := sampleShares(table, len(weights), 200000)
+		for i, w := range weights {
+			if want := w / total; math.Abs(shares[i]-want) > 0.01 {
+				t.Errorf("веса %v: доля %d = %.4f, ожидалось %.4f", weights, i, shares[i], want)
+			}
+			if w == 0 && shares[i] != 0 {
+				t.Errorf("веса %v: выбран индекс %d с нулевым весом", weights, i)
+			}
+		}
+	}
+}
+
+func TestAliasTableZeroWeights(t *testing.T) {
+	// Без положительных весов выборка равномерная
+	shares := sampleShares(newAliasTable([]float64{0, 0, 0}), 3, 30000)
+	for i, share := range shares {
+		if math.Abs(share-1.0/3) > 0.02 {
+			t.Errorf("доля %d = %.4f, ожидалась 1/3", i, share)
+		}
+	}
+
+	if table := newAliasTable(nil); len(table.prob) != 0 || len(table.alias) != 0 {
+		t.Fatalf("таблица для пустого списка: %+v", table)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState описывает состояние автомата защиты прокси
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // Прокси выдается как обычно
+	CircuitOpen                         // Прокси на карантине
+	CircuitHalfOpen                     // Карантин истек, пропускается пробный запрос
+)
+
+// String возвращает текстовое представление состояния
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker отключает прокси после серии ошибок и возвращает его
+// в ротацию после успешного пробного запроса
+type CircuitBreaker struct {
+	mu sync.Mutex
+
+	consecutiveLimit int           // Подряд ошибок до размыкания
+	window           time.Duration // Окно подсчета доли ошибок
+	errorRate        float64       // Доля ошибок в окне для размыкания
+	minRequests      int           // Минимум запросов в окне для оценки доли ошибок
+	baseBackoff      time.Duration // Начальная длительность карантина
+	maxBackoff       time.Duration // Максимальная длительность карантина
+	trialTimeout     time.Duration // Через сколько считать пробный запрос потерянным
+
+	state             CircuitState
+	consecutiveErrors int
+	windowStart       time.Time
+	windowRequests    int
+	windowErrors      int
+	backoff           time.Duration // Длительность текущего карантина
+	openUntil         time.Time     // Окончание текущего карантина
+	trialStarted      time.Time     // Время выдачи пробного запроса (нулевое, если его нет)
+	trips             int           // Сколько раз автомат размыкался
+}
+
+// ConsecutiveErrors возвращает количество ошибок подряд
+func (cb *CircuitBreaker) ConsecutiveErrors() int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.consecutiveErrors
+}
+
+// newCircuitBreaker создает автомат защиты с параметрами из конфигурации
+func newCircuitBreaker(config *Config) *CircuitBreaker {
+	return &CircuitBreaker{
+		consecutiveLimit: config.BreakerConsecutiveErrors,
+		window:           time.Duration(config.BreakerWindow) * time.Second,
+		errorRate:        config.BreakerErrorRate,
+		minRequests:      config.BreakerMinRequests,
+		baseBackoff:      time.Duration(config.BreakerBaseBackoff) * time.Second,
+		maxBackoff:       time.Duration(config.BreakerMaxBackoff) * time.Second,
+		trialTimeout:     2 * time.Duration(config.Timeout) * time.Second,
+	}
+}
+
+// Ready сообщает, можно ли сейчас выдать прокси, не изменяя состояние
+func (cb *CircuitBreaker) Ready(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		return !now.Before(cb.openUntil)
+	case CircuitHalfOpen:
+		return cb.trialStarted.IsZero() || now.Sub(cb.trialStarted) > cb.trialTimeout
+	default:
+		return true
+	}
+}
+
+// Acquire резервирует запрос через прокси. В полуоткрытом состоянии
+// пропускается только один пробный запрос.
+func (cb *CircuitBreaker) Acquire(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if now.Before(cb.openUntil) {
+			return false
+		}
+		cb.state = CircuitHalfOpen
+		cb.trialStarted = now
+		return true
+	case CircuitHalfOpen:
+		if !cb.trialStarted.IsZero() && now.Sub(cb.trialStarted) <= cb.trialTimeout {
+			return false
+		}
+		cb.trialStarted = now
+		return true
+	default:
+		return true
+	}
+}
+
+// RecordSuccess учитывает успешный запрос. Возвращает true, если прокси
+// вернулся в ротацию после карантина. Закрывает автомат только успех
+// пробного запроса в полуоткрытом состоянии: запрос, начатый до
+// размыкания и завершившийся во время карантина, лишь учитывается в окне.
+func (cb *CircuitBreaker) RecordSuccess(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.rollWindow(now)
+	cb.windowRequests++
+
+	switch cb.state {
+	case CircuitClosed:
+		cb.consecutiveErrors = 0
+		return false
+	case CircuitOpen:
+		return false
+	}
+
+	if cb.trialStarted.IsZero() {
+		// Пробный запрос еще не выдан
+		return false
+	}
+
+	// Пробный запрос прошел, возвращаем прокси в ротацию
+	cb.state = CircuitClosed
+	cb.consecutiveErrors = 0
+	cb.backoff = 0
+	cb.trialStarted = time.Time{}
+	cb.windowStart = now
+	cb.windowRequests = 0
+	cb.windowErrors = 0
+	return true
+}
+
+// AbandonTrial освобождает пробный запрос полуоткрытого автомата, если
+// попытка через прокси прервана без результата: отменена клиентом или
+// проиграла хеджирующей. Иначе прокси был бы заблокирован до истечения
+// trialTimeout. Пробная попытка не отличается от остальных, поэтому отмена
+// любой попытки в полуоткрытом состоянии разрешает новый пробный запрос.
+func (cb *CircuitBreaker) AbandonTrial() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitHalfOpen {
+		cb.trialStarted = time.Time{}
+	}
+}
+
+// RecordFailure учитывает ошибку. Возвращает true, если автомат разомкнулся.
+func (cb *CircuitBreaker) RecordFailure(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.rollWindow(now)
+	cb.windowRequests++
+	cb.windowErrors++
+	cb.consecutiveErrors++
+
+	switch cb.state {
+	case CircuitHalfOpen:
+		// Пробный запрос не прошел: удваиваем карантин
+		cb.trip(now, cb.backoff*2)
+		return true
+	case CircuitOpen:
+		return false
+	}
+
+	if cb.consecutiveLimit > 0 && cb.consecutiveErrors >= cb.consecutiveLimit {
+		cb.trip(now, cb.baseBackoff)
+		return true
+	}
+	if cb.minRequests > 0 && cb.windowRequests >= cb.minRequests &&
+		float64(cb.windowErrors)/float64(cb.windowRequests) >= cb.errorRate {
+		cb.trip(now, cb.baseBackoff)
+		return true
+	}
+	return false
+}
+
+// trip размыкает автомат на указанное время с учетом ограничений
+func (cb *CircuitBreaker) trip(now time.Time, backoff time.Duration) {
+	if backoff < cb.baseBackoff {
+		backoff = cb.baseBackoff
+	}
+	if backoff > cb.maxBackoff {
+		backoff = cb.maxBackoff
+	}
+	cb.state = CircuitOpen
+	cb.backoff = backoff
+	cb.openUntil = now.Add(backoff)
+	cb.trialStarted = time.Time{}
+	cb.trips++
+}
+
+// Reset возвращает автомат в замкнутое состояние и сбрасывает счетчики
+func (cb *CircuitBreaker) Reset() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.state = CircuitClosed
+	cb.consecutiveErrors = 0
+	cb.windowStart = time.Time{}
+	cb.windowRequests = 0
+	cb.windowErrors = 0
+	cb.backoff = 0
+	cb.openUntil = time.Time{}
+	cb.trialStarted = time.Time{}
+	cb.trips = 0
+}
+
+// savedCircuit — состояние автомата защиты в файле состояния
+type savedCircuit struct {
+	State             string    `json:"state"`
+	ConsecutiveErrors int       `json:"consecutive_errors"`
+	BackoffMs         int64     `json:"backoff_ms,omitempty"`
+	OpenUntil         time.Time `json:"open_until"`
+	Trips             int       `json:"trips"`
+}
+
+// save возвращает состояние автомата для сохранения
+func (cb *CircuitBreaker) save() savedCircuit {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return savedCircuit{
+		State:             cb.state.String(),
+		ConsecutiveErrors: cb.consecutiveErrors,
+		BackoffMs:         cb.backoff.Milliseconds(),
+		OpenUntil:         cb.openUntil,
+		Trips:             cb.trips,
+	}
+}
+
+// restore восстанавливает сохраненное состояние. Истекший за время простоя
+// карантин заканчивается пробным запросом, как и без перезапуска.
+func (cb *CircuitBreaker) restore(saved savedCircuit) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch saved.State {
+	case CircuitOpen.String():
+		cb.state = CircuitOpen
+	case CircuitHalfOpen.String():
+		// Пробный запрос потерян при остановке, разрешаем новый
+		cb.state = CircuitHalfOpen
+	default:
+		cb.state = CircuitClosed
+	}
+	cb.consecutiveErrors = saved.ConsecutiveErrors
+	cb.backoff = time.Duration(saved.BackoffMs) * time.Millisecond
+	cb.openUntil = saved.OpenUntil
+	cb.trialStarted = time.Time{}
+	cb.trips = saved.Trips
+}
+
+// rollWindow начинает новое окно подсчета, если текущее истекло
+func (cb *CircuitBreaker) rollWindow(now time.Time) {
+	if now.Sub(cb.windowStart) > cb.window {
+		cb.windowStart = now
+		cb.windowRequests = 0
+		cb.windowErrors = 0
+	}
+}
+
+// State возвращает текущее состояние с учетом истекшего карантина
+func (cb *CircuitBreaker) State(now time.Time) CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen && !now.Before(cb.openUntil) {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+// Snapshot возвращает сведения об автомате для статистики
+func (cb *CircuitBreaker) Snapshot(now time.Time) map[string]interface{} {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	state := cb.state
+	if state == CircuitOpen && !now.Before(cb.openUntil) {
+		state = CircuitHalfOpen
+	}
+
+	snapshot := map[string]interface{}{
+		"state":              state.String(),
+		"consecutive_errors": cb.consecutiveErrors,
+		"trips":              cb.trips,
+	}
+	if state != CircuitClosed {
+		snapshot["open_until"] = cb.openUntil
+		snapshot["backoff_seconds"] = cb.backoff.Seconds()
+	}
+	return snapshot
+}
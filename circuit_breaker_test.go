@@ -0,0 +1,220 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// breakerTestStart — момент, от которого отсчитывается время в тестах автомата
+var breakerTestStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestBreaker создает автомат: карантин после 3 ошибок подряд или при
+// доле ошибок 0.5 из 10 запросов за минуту, карантин от 5 до 20 секунд,
+// пробный запрос считается потерянным через 10 секунд
+func newTestBreaker() *CircuitBreaker {
+	return newCircuitBreaker(&Config{
+		BreakerConsecutiveErrors: 3,
+		BreakerWindow:            60,
+		BreakerErrorRate:         0.5,
+		BreakerMinRequests:       10,
+		BreakerBaseBackoff:       5,
+		BreakerMaxBackoff:        20,
+		Timeout:                  5,
+	})
+}
+
+// at возвращает момент через seconds секунд от начала теста
+func at(seconds float64) time.Time {
+	return breakerTestStart.Add(time.Duration(seconds * float64(time.Second)))
+}
+
+// tripBreaker размыкает автомат ошибками подряд в момент now
+func tripBreaker(t *testing.T, cb *CircuitBreaker, now time.Time) {
+	t.Helper()
+	for i := 0; i < 3; i++ {
+		if !cb.Acquire(now) {
+			t.Fatalf("запрос %d до размыкания не выдан", i+1)
+		}
+		if tripped := cb.RecordFailure(now); tripped != (i == 2) {
+			t.Fatalf("ошибка %d: размыкание %v", i+1, tripped)
+		}
+	}
+}
+
+func TestCircuitBreakerConsecutiveErrors(t *testing.T) {
+	cb := newTestBreaker()
+
+	// Успех сбрасывает счетчик ошибок подряд
+	cb.RecordFailure(at(0))
+	cb.RecordFailure(at(0))
+	cb.RecordSuccess(at(0))
+	if cb.ConsecutiveErrors() != 0 || cb.State(at(0)) != CircuitClosed {
+		t.Fatalf("после успеха: ошибок %d, состояние %v", cb.ConsecutiveErrors(), cb.State(at(0)))
+	}
+
+	tripBreaker(t, cb, at(1))
+	if cb.State(at(1)) != CircuitOpen || cb.Ready(at(5.9)) || cb.Acquire(at(5.9)) {
+		t.Fatal("прокси выдается во время карантина")
+	}
+	if cb.State(at(6)) != CircuitHalfOpen || !cb.Ready(at(6)) {
+		t.Fatalf("после карантина состояние %v", cb.State(at(6)))
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	cb := newTestBreaker()
+	for i := 0; i < 9; i++ {
+		if i%2 == 0 {
+			cb.RecordSuccess(at(float64(i)))
+		} else if cb.RecordFailure(at(float64(i))) {
+			t.Fatalf("размыкание до набора минимума запросов на запросе %d", i+1)
+		}
+	}
+	// Десятый запрос: 5 ошибок из 10
+	if !cb.RecordFailure(at(9)) {
+		t.Fatal("нет размыкания при доле ошибок 0.5")
+	}
+
+	// Ошибки прошлого окна не учитываются
+	cb = newTestBreaker()
+	for i := 0; i < 9; i++ {
+		cb.RecordSuccess(at(0))
+		if i < 2 {
+			cb.RecordFailure(at(0))
+		}
+	}
+	cb.RecordSuccess(at(0))
+	for i := 0; i < 9; i++ {
+		cb.RecordSuccess(at(61))
+	}
+	if cb.RecordFailure(at(61)) || cb.State(at(61)) != CircuitClosed {
+		t.Fatal("размыкание по ошибкам прошлого окна")
+	}
+}
+
+func TestCircuitBreakerHalfOpenTrial(t *testing.T) {
+	cb := newTestBreaker()
+	tripBreaker(t, cb, at(0))
+
+	// Запрос, начатый до карантина, не возвращает прокси в ротацию
+	if cb.RecordSuccess(at(1)) || cb.State(at(1)) != CircuitOpen {
+		t.Fatal("успех во время карантина замкнул автомат")
+	}
+
+	// После карантина выдается ровно один пробный запрос
+	if !cb.Acquire(at(5)) {
+		t.Fatal("пробный запрос не выдан")
+	}
+	if cb.Acquire(at(5)) || cb.Ready(at(5)) {
+		t.Fatal("выдан второй пробный запрос")
+	}
+	if !cb.RecordSuccess(at(6)) {
+		t.Fatal("успех пробного запроса не замкнул автомат")
+	}
+	if cb.State(at(6)) != CircuitClosed || cb.ConsecutiveErrors() != 0 {
+		t.Fatalf("после пробного запроса: %v, ошибок %d", cb.State(at(6)), cb.ConsecutiveErrors())
+	}
+
+	// Следующее размыкание снова начинается с базового карантина
+	tripBreaker(t, cb, at(10))
+	if cb.Ready(at(14.9)) || !cb.Ready(at(15)) {
+		t.Fatal("карантин после восстановления не базовый")
+	}
+}
+
+func TestCircuitBreakerBackoffGrowth(t *testing.T) {
+	cb := newTestBreaker()
+	tripBreaker(t, cb, at(0))
+
+	now := 0.0
+	for _, backoff := range []float64{5, 10, 20, 20} {
+		if cb.Ready(at(now + backoff - 0.1)) {
+			t.Fatalf("карантин короче %g с", backoff)
+		}
+		now += backoff
+		if !cb.Acquire(at(now)) {
+			t.Fatalf("пробный запрос не выдан после %g с", backoff)
+		}
+		// Неудача пробного запроса удваивает карантин, но не больше максимума
+		if !cb.RecordFailure(at(now)) {
+			t.Fatal("неудачный пробный запрос не разомкнул автомат")
+		}
+	}
+	if snapshot := cb.Snapshot(at(now)); snapshot["backoff_seconds"] != 20.0 || snapshot["trips"] != 5 {
+		t.Fatalf("сводка автомата: %v", snapshot)
+	}
+}
+
+func TestCircuitBreakerTrialTimeout(t *testing.T) {
+	cb := newTestBreaker()
+	tripBreaker(t, cb, at(0))
+	if !cb.Acquire(at(5)) {
+		t.Fatal("пробный запрос не выдан")
+	}
+
+	// Пробный запрос без результата считается потерянным через trialTimeout
+	if cb.Acquire(at(15)) {
+		t.Fatal("новый пробный запрос выдан до истечения trialTimeout")
+	}
+	if !cb.Ready(at(15.1)) || !cb.Acquire(at(15.1)) {
+		t.Fatal("новый пробный запрос не выдан после trialTimeout")
+	}
+	if cb.Acquire(at(15.2)) {
+		t.Fatal("выдан второй пробный запрос после trialTimeout")
+	}
+}
+
+func TestCircuitBreakerAbandonTrial(t *testing.T) {
+	cb := newTestBreaker()
+
+	// В замкнутом и разомкнутом состоянии отмена попытки ничего не меняет
+	cb.AbandonTrial()
+	tripBreaker(t, cb, at(0))
+	cb.AbandonTrial()
+	if cb.Ready(at(1)) {
+		t.Fatal("отмена попытки прервала карантин")
+	}
+
+	if !cb.Acquire(at(5)) {
+		t.Fatal("пробный запрос не выдан")
+	}
+	// Отмененный пробный запрос сразу освобождает место для нового
+	cb.AbandonTrial()
+	if cb.State(at(5)) != CircuitHalfOpen || !cb.Acquire(at(5.1)) {
+		t.Fatal("после отмены пробного запроса новый не выдан")
+	}
+	if cb.Acquire(at(5.2)) {
+		t.Fatal("выдан второй пробный запрос")
+	}
+	if !cb.RecordSuccess(at(6)) {
+		t.Fatal("успех нового пробного запроса не замкнул автомат")
+	}
+}
+
+func TestCircuitBreakerSaveRestore(t *testing.T) {
+	cb := newTestBreaker()
+	tripBreaker(t, cb, at(0))
+	saved := cb.save()
+
+	restored := newTestBreaker()
+	restored.restore(saved)
+	if restored.State(at(1)) != CircuitOpen || restored.Ready(at(4.9)) || !restored.Ready(at(5)) {
+		t.Fatal("карантин не восстановлен")
+	}
+	if restored.ConsecutiveErrors() != 3 || restored.save() != saved {
+		t.Fatalf("восстановлено %+v, сохранено %+v", restored.save(), saved)
+	}
+
+	// Пробный запрос, выданный до остановки, потерян: разрешается новый
+	cb.Acquire(at(5))
+	restored = newTestBreaker()
+	restored.restore(cb.save())
+	if !restored.Acquire(at(5)) {
+		t.Fatal("после восстановления полуоткрытого автомата пробный запрос не выдан")
+	}
+
+	cb.Reset()
+	if cb.State(at(5)) != CircuitClosed || cb.ConsecutiveErrors() != 0 || cb.Snapshot(at(5))["trips"] != 0 {
+		t.Fatalf("после Reset: %v", cb.Snapshot(at(5)))
+	}
+}
@@ -2,18 +2,112 @@ package main
 
 import (
 	"encoding/json"
+	"net/http"
 	"os"
 )
 
 // Config содержит настройки прокси сервера
 type Config struct {
 	ListenAddr    string `json:"listen_addr"`    // Адрес для прослушивания
-	ProxiesFile   string `json:"proxies_file"`   // Файл со списком прокси в JSON формате
+	ProxiesFile   string `json:"proxies_file"`   // Файл со списком прокси
+	ProxiesFormat string `json:"proxies_format"` // Формат файла прокси: auto, json, jsonl, csv, text
+	ProxyCAFile   string `json:"proxy_ca_file"`  // CA-бандл по умолчанию для https-прокси (пусто — системный)
 	Timeout       int    `json:"timeout"`        // Таймаут в секундах
 	WorkerCount   int    `json:"worker_count"`   // Количество воркеров
 	MetricsAddr   string `json:"metrics_addr"`   // Адрес для метрик
-	CheckInterval int    `json:"check_interval"` // Интервал проверки прокси (сек)
+	CheckInterval int    `json:"check_interval"` // Интервал проверки прокси (сек), отрицательное значение отключает проверку
 	MaxIdleConns  int    `json:"max_idle_conns"` // Максимальное количество простаивающих соединений
+
+	// Процентили задержки каждого прокси за скользящие окна в /metrics
+	// (15 рядов на прокси); в /proxies они выводятся всегда
+	MetricsProxyLatencyWindows bool `json:"metrics_proxy_latency_windows"`
+
+	// Счетчики и показатели каждого прокси в /metrics (11 рядов на прокси);
+	// в /proxies они выводятся всегда
+	MetricsProxySeries bool `json:"metrics_proxy_series"`
+
+	// Настройки активной проверки прокси
+	CheckTarget      string `json:"check_target"`      // host:port, к которому выполняется CONNECT через прокси
+	CheckURL         string `json:"check_url"`         // URL для контрольного HTTP-запроса через прокси
+	CheckTimeout     int    `json:"check_timeout"`     // Таймаут одной проверки (сек)
+	CheckConcurrency int    `json:"check_concurrency"` // Количество одновременных проверок
+	CheckFailures    int    `json:"check_failures"`    // Подряд неудачных проверок до пометки прокси нерабочим
+
+	// Настройки автомата защиты (circuit breaker) прокси
+	BreakerConsecutiveErrors int     `json:"breaker_consecutive_errors"` // Подряд ошибок до карантина
+	BreakerWindow            int     `json:"breaker_window"`             // Окно подсчета доли ошибок (сек)
+	BreakerErrorRate         float64 `json:"breaker_error_rate"`         // Доля ошибок в окне до карантина
+	BreakerMinRequests       int     `json:"breaker_min_requests"`       // Минимум запросов в окне для оценки доли ошибок
+	BreakerBaseBackoff       int     `json:"breaker_base_backoff"`       // Начальная длительность карантина (сек)
+	BreakerMaxBackoff        int     `json:"breaker_max_backoff"`        // Максимальная длительность карантина (сек)
+
+	// Стратегия выбора прокси: lru, round-robin, random, weighted,
+	// least-connections, lowest-latency, p2c
+	Selector          string            `json:"selector"`
+	EndpointSelectors map[string]string `json:"endpoint_selectors"` // Стратегии для отдельных эндпоинтов
+
+	ReloadInterval int `json:"proxies_reload_interval"` // Интервал проверки изменения файла прокси (сек), 0 — только по SIGHUP
+	DrainTimeout   int `json:"drain_timeout"`           // Ожидание завершения запросов через удаленный прокси (сек)
+
+	// Управление списком прокси через /admin/proxies на сервере метрик
+	AdminToken   string `json:"admin_token"`   // Токен для заголовка Authorization: Bearer, пусто — API отключен
+	AdminPersist bool   `json:"admin_persist"` // Сохранять изменения в proxies_file (только форматы json и jsonl, с другими сервер не запускается); иначе они теряются при перезагрузке списка
+
+	// Сохранение статистики прокси между перезапусками
+	StateFile     string `json:"state_file"`     // Файл состояния, пусто — состояние не сохраняется
+	StateInterval int    `json:"state_interval"` // Интервал сохранения (сек), отрицательное значение — только при остановке
+
+	// Плавная остановка по SIGINT/SIGTERM
+	ShutdownTimeout    int `json:"shutdown_timeout"`     // Общее время на завершение запросов (сек)
+	TunnelDrainTimeout int `json:"tunnel_drain_timeout"` // Ожидание завершения CONNECT-туннелей (сек), после — закрываются
+
+	// Повтор неудачных запросов через другой прокси
+	MaxRetries       int   `json:"max_retries"`        // Максимум повторов, отрицательное значение отключает повторы
+	RetryStatusCodes []int `json:"retry_status_codes"` // Статусы ответа, при которых запрос повторяется
+	RetryBudget      int   `json:"retry_budget"`       // Общий бюджет времени на все попытки (сек)
+	RetryMaxBody     int64 `json:"retry_max_body"`     // Максимальный размер тела, буферизуемого для повтора (байт)
+
+	// Хеджирование запросов; включается для эндпоинта или заголовком X-Proxy-Hedge
+	HedgeDelayMs int `json:"hedge_delay_ms"` // Задержка перед дополнительной попыткой (мс)
+	HedgeCount   int `json:"hedge_count"`    // Количество дополнительных прокси
+
+	// Эндпоинты, доступные по пути /<name>/...; перечитываются по SIGHUP
+	Endpoints []Endpoint `json:"endpoints"`
+
+	// Группы эндпоинтов для рассылки запроса по /group/<name>/...
+	EndpointGroups []EndpointGroup `json:"endpoint_groups"`
+	FanoutResponse string          `json:"fanout_response"` // Ответ по умолчанию: aggregate или first
+	FanoutMaxBody  int64           `json:"fanout_max_body"` // Максимальный размер ответа эндпоинта в сводном ответе (байт), отрицательное значение — без ограничения
+
+	// Здоровье эндпоинтов и переключение на резервные регионы
+	EndpointCheckInterval int `json:"endpoint_check_interval"` // Интервал проверки эндпоинтов (сек), отрицательное значение отключает проверку
+	EndpointFailures      int `json:"endpoint_failures"`       // Подряд неудач до вывода эндпоинта из работы
+	EndpointCooldown      int `json:"endpoint_cooldown"`       // Время, на которое эндпоинт выводится из работы (сек)
+
+	// Виртуальный эндпоинт, направляющий запрос в регион с наименьшей задержкой
+	AutoEndpoint  string   `json:"auto_endpoint"`  // Имя в пути запроса
+	AutoEndpoints []string `json:"auto_endpoints"` // Регионы для выбора (пусто — все эндпоинты)
+
+	// Разбор JSON-RPC запросов для метрик и маршрутизации по методу
+	JSONRPCInspect bool              `json:"jsonrpc_inspect"` // Извлекать метод и id из тела запроса
+	MethodRoutes   map[string]string `json:"method_routes"`   // Метод -> эндпоинт (или auto_endpoint), куда он направляется
+
+	// Лимит запросов к эндпоинту через один прокси (token bucket)
+	RateLimitRPS       float64              `json:"rate_limit_rps"`       // Запросов в секунду, 0 — без ограничения
+	RateLimitBurst     int                  `json:"rate_limit_burst"`     // Размер пачки (по умолчанию — ceil(rps))
+	RateLimitWaitMs    int                  `json:"rate_limit_wait_ms"`   // Ожидание токена, если лимит исчерпан у всех прокси (мс), отрицательное значение — без ожидания
+	EndpointRateLimits map[string]RateLimit `json:"endpoint_rate_limits"` // Лимиты отдельных эндпоинтов
+
+	// Ответы вышестоящего сервера об ограничении частоты запросов
+	RateLimitErrorCodes []int `json:"rate_limit_error_codes"` // Коды ошибок JSON-RPC, означающие ограничение частоты
+	RateLimitCooldownMs int   `json:"rate_limit_cooldown_ms"` // Охлаждение прокси для эндпоинта без Retry-After (мс)
+
+	// Журнал запросов в формате JSON Lines
+	AccessLog           string  `json:"access_log"`             // Путь к файлу, "-" — stdout, пусто — журнал отключен
+	AccessLogMaxSizeMB  int     `json:"access_log_max_size_mb"` // Размер файла для ротации (МБ), отрицательное значение отключает ротацию
+	AccessLogMaxBackups int     `json:"access_log_max_backups"` // Сколько прежних файлов хранить, отрицательное значение — не хранить
+	AccessLogSampleRate float64 `json:"access_log_sample_rate"` // Доля успешных запросов, попадающих в журнал (0..1]
+	AccessLogBodyMax    int     `json:"access_log_body_max"`    // Сколько байт тела запроса сохранять вместе со строкой запроса (для replay), 0 — не сохранять
 }
 
 // LoadConfig загружает конфигурацию из файла
@@ -36,6 +130,9 @@ func LoadConfig(filename string) (*Config, error) {
 	if config.ProxiesFile == "" {
 		config.ProxiesFile = "proxies.json"
 	}
+	if config.ProxiesFormat == "" {
+		config.ProxiesFormat = ProxiesFormatAuto
+	}
 	if config.Timeout == 0 {
 		config.Timeout = 10
 	}
@@ -51,6 +148,112 @@ func LoadConfig(filename string) (*Config, error) {
 	if config.MaxIdleConns == 0 {
 		config.MaxIdleConns = 10000 // Увеличено для максимальной производительности
 	}
+	if config.CheckTarget == "" {
+		config.CheckTarget = "mainnet.block-engine.jito.wtf:443"
+	}
+	if config.CheckURL == "" {
+		config.CheckURL = "https://mainnet.block-engine.jito.wtf/"
+	}
+	if config.CheckTimeout == 0 {
+		config.CheckTimeout = 5
+	}
+	if config.CheckConcurrency == 0 {
+		config.CheckConcurrency = 100
+	}
+	if config.CheckFailures == 0 {
+		config.CheckFailures = 2
+	}
+	if config.BreakerConsecutiveErrors == 0 {
+		config.BreakerConsecutiveErrors = 5
+	}
+	if config.BreakerWindow == 0 {
+		config.BreakerWindow = 60
+	}
+	if config.BreakerErrorRate == 0 {
+		config.BreakerErrorRate = 0.5
+	}
+	if config.BreakerMinRequests == 0 {
+		config.BreakerMinRequests = 20
+	}
+	if config.BreakerBaseBackoff == 0 {
+		config.BreakerBaseBackoff = 5
+	}
+	if config.BreakerMaxBackoff == 0 {
+		config.BreakerMaxBackoff = 300
+	}
+	if config.Selector == "" {
+		config.Selector = SelectorWeighted
+	}
+	if config.DrainTimeout == 0 {
+		config.DrainTimeout = 30
+	}
+	if config.StateInterval == 0 {
+		config.StateInterval = 60
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 30
+	}
+	if config.TunnelDrainTimeout == 0 {
+		config.TunnelDrainTimeout = 10
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 2
+	}
+	if config.RetryStatusCodes == nil {
+		config.RetryStatusCodes = []int{
+			http.StatusProxyAuthRequired,
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+		}
+	}
+	if config.RetryBudget == 0 {
+		config.RetryBudget = 2 * config.Timeout
+	}
+	if config.RetryMaxBody == 0 {
+		config.RetryMaxBody = 1024 * 1024
+	}
+	if config.HedgeDelayMs == 0 {
+		config.HedgeDelayMs = 100
+	}
+	if config.HedgeCount == 0 {
+		config.HedgeCount = 1
+	}
+	if config.FanoutResponse == "" {
+		config.FanoutResponse = FanoutResponseAggregate
+	}
+	if config.FanoutMaxBody == 0 {
+		config.FanoutMaxBody = 4 * 1024 * 1024
+	}
+	if config.EndpointCheckInterval == 0 {
+		config.EndpointCheckInterval = 30
+	}
+	if config.EndpointFailures == 0 {
+		config.EndpointFailures = 3
+	}
+	if config.EndpointCooldown == 0 {
+		config.EndpointCooldown = 30
+	}
+	if config.RateLimitWaitMs == 0 {
+		config.RateLimitWaitMs = 200
+	}
+	if config.RateLimitErrorCodes == nil {
+		config.RateLimitErrorCodes = []int{-32097}
+	}
+	if config.RateLimitCooldownMs == 0 {
+		config.RateLimitCooldownMs = 1000
+	}
+	if config.AccessLogMaxSizeMB == 0 {
+		config.AccessLogMaxSizeMB = 100
+	}
+	if config.AccessLogMaxBackups == 0 {
+		config.AccessLogMaxBackups = 5
+	}
+	if config.AccessLogSampleRate <= 0 || config.AccessLogSampleRate > 1 {
+		config.AccessLogSampleRate = 1
+	}
+	if config.AutoEndpoint == "" {
+		config.AutoEndpoint = "jitoAUTO"
+	}
 
 	return &config, nil
 }
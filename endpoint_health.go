@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// endpointState — состояние здоровья одного эндпоинта
+type endpointState struct {
+	consecutiveFailures int
+	downUntil           time.Time // Эндпоинт пропускается до этого момента
+	lastError           string
+	lastCheck           time.Time
+	latencyMs           float64 // Сглаженная задержка успешных ответов (EWMA), 0 — нет замеров
+}
+
+// endpointHealth отслеживает здоровье эндпоинтов по исходам запросов
+// (пассивно) и по результатам проверок (активно). После endpoint_failures
+// неудач подряд эндпоинт пропускается в течение endpoint_cooldown.
+type endpointHealth struct {
+	mu       sync.Mutex
+	states   map[string]*endpointState
+	failures int
+	cooldown time.Duration
+}
+
+// newEndpointHealth создает трекер здоровья эндпоинтов
+func newEndpointHealth(config *Config) *endpointHealth {
+	return &endpointHealth{
+		states:   make(map[string]*endpointState),
+		failures: config.EndpointFailures,
+		cooldown: time.Duration(config.EndpointCooldown) * time.Second,
+	}
+}
+
+// state возвращает состояние эндпоинта, создавая его при необходимости.
+// Вызывается под h.mu.
+func (h *endpointHealth) state(name string) *endpointState {
+	st, ok := h.states[name]
+	if !ok {
+		st = &endpointState{}
+		h.states[name] = st
+	}
+	return st
+}
+
+// Available сообщает, можно ли направлять запросы на эндпоинт
+func (h *endpointHealth) Available(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := h.states[name]
+	return !ok || time.Now().After(st.downUntil)
+}
+
+// RecordSuccess учитывает успешный ответ эндпоинта и его задержку
+func (h *endpointHealth) RecordSuccess(name string, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := h.state(name)
+	sample := float64(latency) / float64(time.Millisecond)
+	if st.latencyMs == 0 {
+		st.latencyMs = sample
+	} else {
+		st.latencyMs += latencyEWMAAlpha * (sample - st.latencyMs)
+	}
+	if !st.downUntil.IsZero() {
+		log.Printf("Эндпоинт %s снова доступен", name)
+	}
+	st.consecutiveFailures = 0
+	st.downUntil = time.Time{}
+	st.lastError = ""
+}
+
+// RecordFailure учитывает ошибку эндпоинта. Возвращает true, если эндпоинт
+// выведен из работы на время cooldown.
+func (h *endpointHealth) RecordFailure(name, reason string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := h.state(name)
+	st.consecutiveFailures++
+	st.lastError = reason
+	if st.consecutiveFailures < h.failures {
+		return false
+	}
+
+	// Повторная неудача после окончания cooldown снова выводит эндпоинт из работы
+	now := time.Now()
+	if now.Before(st.downUntil) {
+		return false
+	}
+	st.downUntil = now.Add(h.cooldown)
+	log.Printf("Эндпоинт %s выведен из работы на %v: %s", name, h.cooldown, reason)
+	return true
+}
+
+// Latency возвращает сглаженную задержку эндпоинта, если есть замеры
+func (h *endpointHealth) Latency(name string) (float64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := h.states[name]
+	if !ok || st.latencyMs == 0 {
+		return 0, false
+	}
+	return st.latencyMs, true
+}
+
+// byLatency упорядочивает эндпоинты по сглаженной задержке. Эндпоинты без
+// замеров идут после измеренных в исходном порядке.
+func (h *endpointHealth) byLatency(endpoints []*Endpoint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	latency := func(ep *Endpoint) float64 {
+		if st, ok := h.states[ep.Name]; ok && st.latencyMs > 0 {
+			return st.latencyMs
+		}
+		return -1
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		li, lj := latency(endpoints[i]), latency(endpoints[j])
+		if li < 0 || lj < 0 {
+			return lj < 0 && li >= 0
+		}
+		return li < lj
+	})
+}
+
+// markChecked запоминает время активной проверки эндпоинта
+func (h *endpointHealth) markChecked(name string, at time.Time) {
+	h.mu.Lock()
+	h.state(name).lastCheck = at
+	h.mu.Unlock()
+}
+
+// Snapshot возвращает состояние эндпоинтов для метрик
+func (h *endpointHealth) Snapshot(names []string) map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	result := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		st, ok := h.states[name]
+		if !ok {
+			result[name] = map[string]interface{}{"available": true}
+			continue
+		}
+
+		entry := map[string]interface{}{
+			"available":            now.After(st.downUntil),
+			"consecutive_failures": st.consecutiveFailures,
+		}
+		if st.latencyMs > 0 {
+			entry["latency_ms"] = st.latencyMs
+		}
+		if now.Before(st.downUntil) {
+			entry["cooldown_remaining_s"] = int(st.downUntil.Sub(now).Seconds())
+		}
+		if st.lastError != "" {
+			entry["last_error"] = st.lastError
+		}
+		if !st.lastCheck.IsZero() {
+			entry["last_check"] = st.lastCheck.Format(time.RFC3339)
+		}
+		result[name] = entry
+	}
+	return result
+}
+
+// isEndpointFailure сообщает, считается ли исход запроса отказом эндпоинта:
+// ошибка соединения или ответ 5xx
+func isEndpointFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+// proxySideError — ошибка попытки, возникшая до соединения с эндпоинтом:
+// отказ соединения с прокси, в CONNECT или авторизации SOCKS
+type proxySideError struct {
+	err error
+}
+
+func (e *proxySideError) Error() string { return e.err.Error() }
+func (e *proxySideError) Unwrap() error { return e.err }
+
+// traceEndpointConn добавляет в ctx отслеживание соединения с эндпоинтом
+// через прокси. Возвращенная функция сообщает, что соединение установлено:
+// получено соединение или начато TLS-рукопожатие с эндпоинтом внутри
+// туннеля. Колбэки могут вызываться из горутины установки соединения.
+func traceEndpointConn(ctx context.Context) (context.Context, func() bool) {
+	var reached int32
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { atomic.StoreInt32(&reached, 1) },
+		GotConn:           func(httptrace.GotConnInfo) { atomic.StoreInt32(&reached, 1) },
+	})
+	return ctx, func() bool { return atomic.LoadInt32(&reached) == 1 }
+}
+
+// isProxyFailure сообщает, что неудача попытки вызвана прокси, а не
+// эндпоинтом: ошибка до соединения с эндпоинтом, отказ в авторизации на
+// прокси или 502 от HTTP-прокси, который сам запрашивает http-эндпоинт.
+// Такие неудачи не засчитываются эндпоинту, чтобы плохие прокси не
+// выводили из работы исправный регион.
+func isProxyFailure(proxy *Proxy, resp *http.Response, err error) bool {
+	if err != nil {
+		var proxyErr *proxySideError
+		return errors.As(err, &proxyErr)
+	}
+	switch resp.StatusCode {
+	case http.StatusProxyAuthRequired:
+		return true
+	case http.StatusBadGateway:
+		return proxy != nil && (proxy.Scheme == SchemeHTTP || proxy.Scheme == SchemeHTTPS) &&
+			resp.Request != nil && resp.Request.URL.Scheme == "http"
+	}
+	return false
+}
+
+// StartEndpointChecker запускает периодическую проверку эндпоинтов через прокси.
+// Проверки поддерживают актуальность задержек для автоматического выбора региона.
+func (ps *ProxyServer) StartEndpointChecker() {
+	if ps.config.EndpointCheckInterval < 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(ps.config.EndpointCheckInterval) * time.Second)
+		defer ticker.Stop()
+
+		// Первая проверка сразу, чтобы задержки регионов были известны с начала работы
+		ps.checkAllEndpoints()
+		for range ticker.C {
+			ps.checkAllEndpoints()
+		}
+	}()
+}
+
+// checkAllEndpoints параллельно проверяет все эндпоинты
+func (ps *ProxyServer) checkAllEndpoints() {
+	var wg sync.WaitGroup
+	for _, name := range ps.endpoints.Names() {
+		endpoint, ok := ps.endpoints.Get(name)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(endpoint *Endpoint) {
+			defer wg.Done()
+			ps.probeEndpoint(endpoint)
+		}(endpoint)
+	}
+	wg.Wait()
+}
+
+// probeEndpoint выполняет контрольный запрос к эндпоинту через прокси.
+// Любой ответ, кроме 5xx, считается признаком работоспособности. Если не
+// удалось соединиться через прокси (ошибка соединения с прокси, отказ в
+// CONNECT или авторизации), неудача засчитывается прокси, а не эндпоинту.
+func (ps *ProxyServer) probeEndpoint(endpoint *Endpoint) {
+	proxy := ps.proxyManager.GetProbeProxy(endpoint.Name)
+	if proxy == nil {
+		return
+	}
+	defer ps.proxyManager.ReleaseProxy(proxy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(ps.config.CheckTimeout)*time.Second)
+	defer cancel()
+
+	ctx, reached := traceEndpointConn(ctx)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.TargetURL("/"), nil)
+	if err != nil {
+		return
+	}
+	client := &http.Client{
+		Transport: ps.getTransport(proxy),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	latency := time.Since(start)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	if err != nil && !reached() {
+		err = &proxySideError{err: err}
+	}
+	if isProxyFailure(proxy, resp, err) {
+		ps.proxyManager.IncrementProxyErrorCount(proxy.URL, "проверка эндпоинта: "+attemptFailure(resp, err))
+		return
+	}
+	if err == nil {
+		ps.proxyManager.RecordProxySuccess(proxy.URL, latency)
+	}
+
+	health := ps.endpoints.health
+	health.markChecked(endpoint.Name, start)
+	if isEndpointFailure(resp, err) {
+		health.RecordFailure(endpoint.Name, "проверка: "+attemptFailure(resp, err))
+		return
+	}
+	health.RecordSuccess(endpoint.Name, latency)
+}
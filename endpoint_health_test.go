@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestIsProxyFailure(t *testing.T) {
+	httpProxy := &Proxy{Scheme: SchemeHTTP}
+	socksProxy := &Proxy{Scheme: SchemeSOCKS5}
+	response := func(status int, scheme string) *http.Response {
+		return &http.Response{StatusCode: status, Request: &http.Request{URL: &url.URL{Scheme: scheme, Host: "rpc"}}}
+	}
+	dialErr := errors.New("dial tcp: connection refused")
+
+	for _, tc := range []struct {
+		name          string
+		proxy         *Proxy
+		resp          *http.Response
+		err           error
+		proxyFailure  bool
+		endpointCount bool // Засчитывается ли неудача эндпоинту
+	}{
+		{"ошибка до эндпоинта", httpProxy, nil, &proxySideError{err: dialErr}, true, false},
+		{"обернутая ошибка до эндпоинта", httpProxy, nil, fmt.Errorf("попытка: %w", &proxySideError{err: dialErr}), true, false},
+		{"ошибка после соединения", httpProxy, nil, dialErr, false, true},
+		{"отмена", httpProxy, nil, context.Canceled, false, true},
+		{"407", httpProxy, response(http.StatusProxyAuthRequired, "https"), nil, true, false},
+		{"502 от HTTP-прокси для http", httpProxy, response(http.StatusBadGateway, "http"), nil, true, false},
+		{"502 через туннель", httpProxy, response(http.StatusBadGateway, "https"), nil, false, true},
+		{"502 через SOCKS", socksProxy, response(http.StatusBadGateway, "http"), nil, false, true},
+		{"503", httpProxy, response(http.StatusServiceUnavailable, "http"), nil, false, true},
+		{"200", httpProxy, response(http.StatusOK, "https"), nil, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isProxyFailure(tc.proxy, tc.resp, tc.err); got != tc.proxyFailure {
+				t.Fatalf("isProxyFailure = %v, ожидалось %v", got, tc.proxyFailure)
+			}
+			counted := isEndpointFailure(tc.resp, tc.err) && !isProxyFailure(tc.proxy, tc.resp, tc.err)
+			if counted != tc.endpointCount {
+				t.Fatalf("неудача эндпоинта = %v, ожидалось %v", counted, tc.endpointCount)
+			}
+		})
+	}
+
+	if !isCanceled(&proxySideError{err: context.Canceled}) {
+		t.Fatal("отмена внутри proxySideError не распознается")
+	}
+}
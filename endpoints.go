@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Endpoint описывает целевой сервер, доступный по пути /<name>/...
+type Endpoint struct {
+	Name       string            `json:"name"`                  // Имя эндпоинта в пути запроса
+	URL        string            `json:"url"`                   // Базовый URL сервера
+	PathPrefix string            `json:"path_prefix,omitempty"` // Префикс, добавляемый к пути запроса
+	Headers    map[string]string `json:"headers,omitempty"`     // Заголовки по умолчанию
+	Hedge      *HedgeConfig      `json:"hedge,omitempty"`       // Хеджирование запросов к эндпоинту
+	Failover   []string          `json:"failover,omitempty"`    // Резервные эндпоинты в порядке очередности
+}
+
+// defaultEndpoints используются, если эндпоинты не заданы в конфигурации
+var defaultEndpoints = []Endpoint{
+	{Name: "jitoNY", URL: "https://ny.mainnet.block-engine.jito.wtf"},
+	{Name: "jitoTOKIO", URL: "https://tokyo.mainnet.block-engine.jito.wtf"},
+	{Name: "jitoSLC", URL: "https://slc.mainnet.block-engine.jito.wtf"},
+	{Name: "jitoAMSTERDAM", URL: "https://amsterdam.mainnet.block-engine.jito.wtf"},
+	{Name: "jitoFRANKFURT", URL: "https://frankfurt.mainnet.block-engine.jito.wtf"},
+	{Name: "jitoLONDON", URL: "https://london.mainnet.block-engine.jito.wtf"},
+}
+
+// EndpointRegistry хранит текущую карту эндпоинтов и групп и позволяет
+// заменять ее во время работы без блокировок на чтение
+type EndpointRegistry struct {
+	set    atomic.Value    // *endpointSet
+	health *endpointHealth // Здоровье эндпоинтов, сохраняется при перезагрузке
+
+	autoName      string   // Виртуальный эндпоинт с выбором региона по задержке
+	autoEndpoints []string // Регионы для автоматического выбора (пусто — все)
+}
+
+// endpointSet — неизменяемый снимок эндпоинтов и групп
+type endpointSet struct {
+	endpoints map[string]*Endpoint
+	groups    map[string]*EndpointGroup
+}
+
+// NewEndpointRegistry создает реестр из эндпоинтов и групп конфигурации
+func NewEndpointRegistry(config *Config) (*EndpointRegistry, error) {
+	er := &EndpointRegistry{
+		health:        newEndpointHealth(config),
+		autoName:      config.AutoEndpoint,
+		autoEndpoints: config.AutoEndpoints,
+	}
+	if err := er.Update(config.Endpoints, config.EndpointGroups); err != nil {
+		return nil, err
+	}
+	return er, nil
+}
+
+// Update проверяет списки и атомарно заменяет карту эндпоинтов и групп.
+// Пустой список эндпоинтов заменяется эндпоинтами по умолчанию.
+func (er *EndpointRegistry) Update(list []Endpoint, groups []EndpointGroup) error {
+	if len(list) == 0 {
+		list = defaultEndpoints
+	}
+
+	endpoints := make(map[string]*Endpoint, len(list))
+	for i := range list {
+		ep := list[i]
+		if ep.Name == "" || strings.Contains(ep.Name, "/") {
+			return fmt.Errorf("эндпоинт #%d: некорректное имя %q", i+1, ep.Name)
+		}
+		if ep.Name == FanoutAllPath || ep.Name == FanoutGroupPath || ep.Name == er.autoName {
+			return fmt.Errorf("эндпоинт #%d: имя %q зарезервировано", i+1, ep.Name)
+		}
+		if _, dup := endpoints[ep.Name]; dup {
+			return fmt.Errorf("эндпоинт %s указан повторно", ep.Name)
+		}
+
+		u, err := url.Parse(ep.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("эндпоинт %s: некорректный URL %q", ep.Name, ep.URL)
+		}
+		ep.URL = strings.TrimSuffix(ep.URL, "/")
+
+		if ep.Hedge != nil {
+			switch ep.Hedge.Mode {
+			case HedgeModeOff, HedgeModeDelay, HedgeModeRace:
+			default:
+				return fmt.Errorf("эндпоинт %s: неизвестный режим хеджирования %q", ep.Name, ep.Hedge.Mode)
+			}
+		}
+
+		if ep.PathPrefix != "" {
+			ep.PathPrefix = "/" + strings.Trim(ep.PathPrefix, "/")
+		}
+
+		endpoints[ep.Name] = &ep
+	}
+
+	for _, ep := range endpoints {
+		seen := make(map[string]bool, len(ep.Failover))
+		for _, name := range ep.Failover {
+			if _, ok := endpoints[name]; !ok || name == ep.Name || seen[name] {
+				return fmt.Errorf("эндпоинт %s: некорректный резервный эндпоинт %s", ep.Name, name)
+			}
+			seen[name] = true
+		}
+	}
+
+	for _, name := range er.autoEndpoints {
+		if _, ok := endpoints[name]; !ok {
+			return fmt.Errorf("%s: неизвестный эндпоинт %s", er.autoName, name)
+		}
+	}
+
+	groupMap := make(map[string]*EndpointGroup, len(groups))
+	for i := range groups {
+		g := groups[i]
+		if g.Name == "" || strings.Contains(g.Name, "/") {
+			return fmt.Errorf("группа #%d: некорректное имя %q", i+1, g.Name)
+		}
+		if g.Name == FanoutAllPath || g.Name == FanoutGroupPath || g.Name == er.autoName {
+			return fmt.Errorf("группа #%d: имя %q зарезервировано", i+1, g.Name)
+		}
+		if _, clash := endpoints[g.Name]; clash {
+			return fmt.Errorf("группа %s: имя совпадает с именем эндпоинта", g.Name)
+		}
+		if _, dup := groupMap[g.Name]; dup {
+			return fmt.Errorf("группа %s указана повторно", g.Name)
+		}
+		if len(g.Endpoints) == 0 {
+			return fmt.Errorf("группа %s: не указаны эндпоинты", g.Name)
+		}
+		seen := make(map[string]bool, len(g.Endpoints))
+		for _, name := range g.Endpoints {
+			if _, ok := endpoints[name]; !ok {
+				return fmt.Errorf("группа %s: неизвестный эндпоинт %s", g.Name, name)
+			}
+			if seen[name] {
+				return fmt.Errorf("группа %s: эндпоинт %s указан повторно", g.Name, name)
+			}
+			seen[name] = true
+		}
+		switch g.Response {
+		case "", FanoutResponseAggregate, FanoutResponseFirst, GroupModeFailover:
+		default:
+			return fmt.Errorf("группа %s: неизвестный режим ответа %q", g.Name, g.Response)
+		}
+		groupMap[g.Name] = &g
+	}
+
+	er.set.Store(&endpointSet{endpoints: endpoints, groups: groupMap})
+	return nil
+}
+
+// Get возвращает эндпоинт по имени
+func (er *EndpointRegistry) Get(name string) (*Endpoint, bool) {
+	ep, ok := er.load().endpoints[name]
+	return ep, ok
+}
+
+// Names возвращает отсортированный список имен эндпоинтов
+func (er *EndpointRegistry) Names() []string {
+	endpoints := er.load().endpoints
+	names := make([]string, 0, len(endpoints))
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Group возвращает группу по имени. Группа "all" включает все эндпоинты.
+func (er *EndpointRegistry) Group(name string) (*EndpointGroup, bool) {
+	if name == FanoutAllPath {
+		return &EndpointGroup{Name: FanoutAllPath, Endpoints: er.Names()}, true
+	}
+	g, ok := er.load().groups[name]
+	return g, ok
+}
+
+// GroupNames возвращает отсортированный список имен групп
+func (er *EndpointRegistry) GroupNames() []string {
+	groups := er.load().groups
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FailoverChain возвращает эндпоинт и его резервные эндпоинты в порядке
+// очередности. Выведенные из работы эндпоинты переносятся в конец списка,
+// чтобы при отказе всех регионов запрос все же был отправлен.
+func (er *EndpointRegistry) FailoverChain(endpoint *Endpoint) []*Endpoint {
+	names := append([]string{endpoint.Name}, endpoint.Failover...)
+	return er.orderByHealth(names)
+}
+
+// orderByHealth возвращает эндпоинты по списку имен, ставя доступные вперед
+func (er *EndpointRegistry) orderByHealth(names []string) []*Endpoint {
+	up, down := er.splitByHealth(names)
+	return append(up, down...)
+}
+
+// AutoChain возвращает регионы для виртуального эндпоинта auto_endpoint:
+// доступные по возрастанию сглаженной задержки, затем выведенные из работы
+func (er *EndpointRegistry) AutoChain() []*Endpoint {
+	names := er.autoEndpoints
+	if len(names) == 0 {
+		names = er.Names()
+	}
+	up, down := er.splitByHealth(names)
+	er.health.byLatency(up)
+	er.health.byLatency(down)
+	return append(up, down...)
+}
+
+// splitByHealth разделяет эндпоинты по списку имен на доступные и
+// выведенные из работы, сохраняя порядок. Неизвестные имена пропускаются.
+func (er *EndpointRegistry) splitByHealth(names []string) (up, down []*Endpoint) {
+	endpoints := er.load().endpoints
+	for _, name := range names {
+		ep, ok := endpoints[name]
+		if !ok {
+			continue
+		}
+		if er.health.Available(name) {
+			up = append(up, ep)
+		} else {
+			down = append(down, ep)
+		}
+	}
+	return up, down
+}
+
+// Latencies возвращает сглаженные задержки эндпоинтов, по которым есть замеры
+func (er *EndpointRegistry) Latencies() map[string]float64 {
+	result := make(map[string]float64)
+	for _, name := range er.Names() {
+		if latency, ok := er.health.Latency(name); ok {
+			result[name] = latency
+		}
+	}
+	return result
+}
+
+// load возвращает текущий снимок эндпоинтов и групп
+func (er *EndpointRegistry) load() *endpointSet {
+	return er.set.Load().(*endpointSet)
+}
+
+// TargetURL формирует URL целевого сервера для пути запроса после имени эндпоинта
+func (ep *Endpoint) TargetURL(remainingPath string) string {
+	return ep.URL + ep.PathPrefix + remainingPath
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Виртуальные пути рассылки запроса по нескольким эндпоинтам
+const (
+	FanoutAllPath   = "all"   // /all/... — все эндпоинты
+	FanoutGroupPath = "group" // /group/<name>/... — эндпоинты группы
+)
+
+// Режимы ответа на рассылку
+const (
+	FanoutResponseAggregate = "aggregate" // JSON со статусом, задержкой и телом ответа каждого эндпоинта
+	FanoutResponseFirst     = "first"     // Первый успешный ответ, остальные запросы завершаются в фоне
+
+	// GroupModeFailover — запрос отправляется эндпоинтам группы по очереди до первого успеха
+	GroupModeFailover = "failover"
+)
+
+// FanoutResponseHeader переопределяет режим ответа для запроса.
+// В вышестоящий сервер не передается.
+const FanoutResponseHeader = "X-Proxy-Fanout"
+
+// FanoutEndpointHeader указывает в ответе first эндпоинт, чей ответ получен
+const FanoutEndpointHeader = "X-Proxy-Endpoint"
+
+// EndpointGroup описывает именованную группу эндпоинтов
+type EndpointGroup struct {
+	Name      string   `json:"name"`               // Имя группы в пути /group/<name>/...
+	Endpoints []string `json:"endpoints"`          // Имена эндпоинтов группы
+	Response  string   `json:"response,omitempty"` // Режим ответа: aggregate, first или failover (по умолчанию fanout_response)
+}
+
+// fanoutResult — результат запроса к одному эндпоинту группы
+type fanoutResult struct {
+	Endpoint  string          `json:"endpoint"`
+	Status    int             `json:"status,omitempty"`
+	LatencyMs int64           `json:"latency_ms"`
+	Body      json.RawMessage `json:"body,omitempty"`
+	Error     string          `json:"error,omitempty"`
+
+	resp  *http.Response
+	proxy *Proxy
+}
+
+// parseFanoutPath распознает пути /all/... и /group/<name>/... и возвращает
+// группу и оставшийся путь
+func (ps *ProxyServer) parseFanoutPath(path string) (*EndpointGroup, string, bool, error) {
+	components := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+
+	var group *EndpointGroup
+	rest := components[1:]
+	switch components[0] {
+	case FanoutAllPath:
+		group, _ = ps.endpoints.Group(FanoutAllPath)
+	case FanoutGroupPath:
+		if len(rest) == 0 || rest[0] == "" {
+			return nil, "", true, fmt.Errorf("Не указана группа эндпоинтов")
+		}
+		var ok bool
+		if group, ok = ps.endpoints.Group(rest[0]); !ok {
+			return nil, "", true, fmt.Errorf("Неизвестная группа эндпоинтов: %s", rest[0])
+		}
+		rest = rest[1:]
+	default:
+		return nil, "", false, nil
+	}
+
+	remainingPath := "/" + strings.Join(rest, "/")
+	return group, remainingPath, true, nil
+}
+
+// handleFanout рассылает запрос параллельно всем эндпоинтам группы, каждому
+// через свой прокси, и отвечает сводным JSON либо первым успешным ответом
+func (ps *ProxyServer) handleFanout(w http.ResponseWriter, r *http.Request, group *EndpointGroup, remainingPath string, body *requestBody) {
+	mode := group.Response
+	if mode == "" {
+		mode = ps.config.FanoutResponse
+	}
+	if value := r.Header.Get(FanoutResponseHeader); value != "" {
+		mode = strings.ToLower(strings.TrimSpace(value))
+	}
+	r.Header.Del(FanoutResponseHeader)
+	if mode == GroupModeFailover {
+		ps.handleHTTP(w, r, ps.endpoints.orderByHealth(group.Endpoints), remainingPath, body)
+		return
+	}
+	if mode != FanoutResponseAggregate && mode != FanoutResponseFirst {
+		ps.metrics.IncrementFailedRequests()
+		http.Error(w, fmt.Sprintf("Неизвестный режим ответа: %s", mode), http.StatusBadRequest)
+		return
+	}
+
+	if !body.replayable {
+		ps.metrics.IncrementFailedRequests()
+		http.Error(w, "Тело запроса слишком велико для рассылки", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// В режиме first запросы к остальным эндпоинтам не отменяются после
+	// ответа клиенту, поэтому не зависят от контекста входящего запроса
+	parent := r.Context()
+	if mode == FanoutResponseFirst {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, time.Duration(ps.config.Timeout)*time.Second)
+
+	// Прокси выбираем заранее, чтобы по возможности не повторять их между эндпоинтами
+	type target struct {
+		endpoint *Endpoint
+		proxy    *Proxy
+		req      *http.Request
+	}
+	var targets []target
+	results := make(chan *fanoutResult, len(group.Endpoints))
+	tried := make(map[*Proxy]bool)
+	for _, name := range group.Endpoints {
+		endpoint, ok := ps.endpoints.Get(name)
+		if !ok {
+			continue
+		}
+		proxy := ps.proxyManager.GetProxyForEndpoint(name, tried)
+		var err error
+		if proxy == nil {
+			proxy, err = ps.acquireProxy(ctx, endpoint, nil)
+		}
+		if proxy == nil {
+			results <- &fanoutResult{Endpoint: name, Error: err.Error()}
+			continue
+		}
+		tried[proxy] = true
+
+		req, err := endpointRequest(r, endpoint, remainingPath)
+		if err != nil {
+			ps.proxyManager.ReleaseProxy(proxy)
+			results <- &fanoutResult{Endpoint: name, Error: fmt.Sprintf("ошибка парсинга URL: %v", err)}
+			continue
+		}
+		targets = append(targets, target{endpoint: endpoint, proxy: proxy, req: req})
+	}
+
+	if len(targets) == 0 {
+		cancel()
+		ps.metrics.IncrementFailedRequests()
+		http.Error(w, "Нет доступных прокси", http.StatusServiceUnavailable)
+		return
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t target) {
+			defer wg.Done()
+			resp, duration, err := ps.doUpstream(ctx, t.proxy, t.req, t.endpoint, body)
+			result := &fanoutResult{Endpoint: t.endpoint.Name, LatencyMs: duration.Milliseconds(), proxy: t.proxy}
+			switch {
+			case isCanceled(err):
+				ps.proxyManager.AbandonProxyAttempt(t.proxy)
+				result.Error = err.Error()
+			case err != nil:
+				ps.proxyManager.IncrementProxyErrorCount(t.proxy.URL, attemptFailure(resp, err))
+				result.Error = err.Error()
+			case ps.shouldRetry(resp, nil):
+				ps.proxyManager.IncrementProxyErrorCount(t.proxy.URL, attemptFailure(resp, err))
+			default:
+				ps.proxyManager.RecordProxySuccess(t.proxy.URL, duration)
+			}
+			if resp != nil {
+				result.Status = resp.StatusCode
+				result.resp = resp
+			}
+			switch {
+			case isCanceled(err), isProxyFailure(t.proxy, resp, err):
+				// Запрос отменен клиентом или ответом другого эндпоинта
+				// либо не дошел до эндпоинта из-за прокси
+			case isEndpointFailure(resp, err):
+				ps.endpoints.health.RecordFailure(t.endpoint.Name, result.failureReason())
+			default:
+				ps.endpoints.health.RecordSuccess(t.endpoint.Name, duration)
+			}
+			results <- result
+		}(t)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var ok bool
+	if entry := accessEntryFrom(r.Context()); entry != nil {
+		entry.Group = group.Name
+	}
+	if mode == FanoutResponseFirst {
+		ok = ps.writeFanoutFirst(w, r, results, start)
+		// Остальные ответы дочитываем в фоне, чтобы вернуть соединения в пул
+		go func() {
+			for result := range results {
+				ps.closeFanoutResult(result)
+			}
+			cancel()
+		}()
+	} else {
+		ok = ps.writeFanoutAggregate(w, r, group, results, start)
+		cancel()
+	}
+
+	if body.rpc != nil {
+		ps.metrics.RecordRPC(body.rpc.Method, time.Since(start), !ok)
+	}
+}
+
+// failureReason описывает причину неудачи для журнала здоровья эндпоинта
+func (result *fanoutResult) failureReason() string {
+	if result.Error != "" {
+		return result.Error
+	}
+	return result.resp.Status
+}
+
+// closeFanoutResult дочитывает и закрывает ответ и освобождает прокси
+func (ps *ProxyServer) closeFanoutResult(result *fanoutResult) {
+	if result.resp != nil {
+		io.Copy(ioutil.Discard, result.resp.Body)
+		result.resp.Body.Close()
+	}
+	if result.proxy != nil {
+		ps.proxyManager.ReleaseProxy(result.proxy)
+	}
+}
+
+// writeFanoutFirst отдает клиенту первый успешный ответ, а при его
+// отсутствии — последний полученный. Возвращает true, если ответ успешный.
+func (ps *ProxyServer) writeFanoutFirst(w http.ResponseWriter, r *http.Request, results <-chan *fanoutResult, start time.Time) bool {
+	var winner, last *fanoutResult
+	for result := range results {
+		if result.resp != nil && result.Status >= 200 && result.Status < 300 {
+			winner = result
+			break
+		}
+		if last != nil {
+			ps.closeFanoutResult(last)
+		}
+		last = result
+	}
+	if winner == nil {
+		winner = last
+	} else if last != nil {
+		ps.closeFanoutResult(last)
+	}
+
+	if winner == nil || winner.resp == nil {
+		errMsg := "нет ответа ни от одного эндпоинта"
+		if winner != nil {
+			errMsg = winner.Error
+			ps.closeFanoutResult(winner)
+		}
+		ps.metrics.IncrementFailedRequests()
+		http.Error(w, fmt.Sprintf("Ошибка запроса: %s", errMsg), http.StatusBadGateway)
+		return false
+	}
+
+	ok := winner.Status >= 200 && winner.Status < 300
+	if ok {
+		ps.metrics.IncrementSuccessfulRequests()
+	} else {
+		ps.metrics.IncrementFailedRequests()
+	}
+	ps.metrics.RecordResponseTime(winner.Endpoint, time.Since(start))
+	accessEntryFrom(r.Context()).setUpstream(winner.Endpoint, winner.proxy, winner.resp, time.Duration(winner.LatencyMs)*time.Millisecond, nil)
+	w.Header().Set(FanoutEndpointHeader, winner.Endpoint)
+	writeUpstreamResponse(w, winner.resp)
+	ps.closeFanoutResult(winner)
+	return ok
+}
+
+// writeFanoutAggregate дожидается ответов всех эндпоинтов и отдает сводный JSON.
+// Статус ответа 200, если хотя бы один эндпоинт ответил успешно, иначе 502.
+// Тело ответа эндпоинта больше fanout_max_body не включается в сводный
+// ответ и считается неудачей. Возвращает true при статусе 200.
+func (ps *ProxyServer) writeFanoutAggregate(w http.ResponseWriter, r *http.Request, group *EndpointGroup, results <-chan *fanoutResult, start time.Time) bool {
+	collected := make(map[string]*fanoutResult, len(group.Endpoints))
+	succeeded := 0
+	for result := range results {
+		if result.resp != nil {
+			maxBody := ps.config.FanoutMaxBody
+			var reader io.Reader = result.resp.Body
+			if maxBody > 0 {
+				reader = io.LimitReader(reader, maxBody+1)
+			}
+			data, err := ioutil.ReadAll(reader)
+			if err == nil && maxBody > 0 && int64(len(data)) > maxBody {
+				// Остаток тела не дочитываем: соединение закрывается
+				result.resp.Body.Close()
+				err = fmt.Errorf("размер больше %d байт", maxBody)
+			}
+			switch {
+			case err != nil:
+				result.Error = fmt.Sprintf("ошибка чтения ответа: %v", err)
+			case json.Valid(data):
+				result.Body = data
+			case len(data) > 0:
+				// Не-JSON тело передаем строкой
+				result.Body, _ = json.Marshal(string(data))
+			}
+			if result.Status >= 200 && result.Status < 300 && err == nil {
+				succeeded++
+			}
+		}
+		ps.closeFanoutResult(result)
+		collected[result.Endpoint] = result
+	}
+
+	// Результаты выводим в порядке эндпоинтов группы
+	ordered := make([]*fanoutResult, 0, len(collected))
+	for _, name := range group.Endpoints {
+		if result, ok := collected[name]; ok {
+			ordered = append(ordered, result)
+		}
+	}
+
+	status := http.StatusOK
+	if succeeded == 0 {
+		status = http.StatusBadGateway
+		ps.metrics.IncrementFailedRequests()
+		accessEntryFrom(r.Context()).setError("нет успешного ответа ни от одного эндпоинта")
+	} else {
+		ps.metrics.IncrementSuccessfulRequests()
+		ps.metrics.RecordGroupTime(group.Name, time.Since(start))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(map[string]interface{}{
+		"group":     group.Name,
+		"succeeded": succeeded,
+		"total":     len(ordered),
+		"results":   ordered,
+	})
+	return succeeded > 0
+}
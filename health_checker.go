@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StartHealthChecker запускает фоновую проверку прокси с интервалом check_interval
+func (pm *ProxyManager) StartHealthChecker() {
+	if pm.config.CheckInterval < 0 {
+		log.Printf("Фоновая проверка прокси отключена")
+		return
+	}
+
+	interval := time.Duration(pm.config.CheckInterval) * time.Second
+	go func() {
+		// Первую проверку выполняем сразу, не дожидаясь тика
+		pm.checkAllProxies()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			pm.checkAllProxies()
+		}
+	}()
+}
+
+// checkAllProxies проверяет все прокси с ограничением параллельности
+func (pm *ProxyManager) checkAllProxies() {
+	pm.mu.RLock()
+	proxies := make([]*Proxy, len(pm.proxies))
+	copy(proxies, pm.proxies)
+	pm.mu.RUnlock()
+
+	startTime := time.Now()
+	sem := make(chan struct{}, pm.config.CheckConcurrency)
+	var wg sync.WaitGroup
+
+	for _, p := range proxies {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(p *Proxy) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			latency, err := pm.probeProxy(p)
+			pm.recordCheckResult(p, latency, err)
+		}(p)
+	}
+	wg.Wait()
+
+	log.Printf("Проверка прокси завершена за %v: рабочих %d из %d",
+		time.Since(startTime).Round(time.Millisecond), pm.GetHealthyProxiesCount(), len(proxies))
+}
+
+// probeProxy выполняет CONNECT до check_target и контрольный HTTP-запрос
+// к check_url через прокси. Возвращает время HTTP-запроса.
+func (pm *ProxyManager) probeProxy(p *Proxy) (time.Duration, error) {
+	timeout := time.Duration(pm.config.CheckTimeout) * time.Second
+
+	// Проверяем, что прокси устанавливает туннель
+	conn, err := dialViaProxy(p, pm.config.CheckTarget, timeout)
+	if err != nil {
+		return 0, fmt.Errorf("CONNECT %s: %v", pm.config.CheckTarget, err)
+	}
+	conn.Close()
+
+	// Замеряем время контрольного запроса
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	configureUpstream(transport, p)
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	startTime := time.Now()
+	resp, err := client.Get(pm.config.CheckURL)
+	if err != nil {
+		return 0, fmt.Errorf("GET %s: %v", pm.config.CheckURL, err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(startTime)
+
+	// Ответ целевого сервера с любым статусом означает, что прокси работает,
+	// кроме отказа самого прокси в авторизации
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return latency, fmt.Errorf("GET %s: прокси требует авторизацию", pm.config.CheckURL)
+	}
+
+	return latency, nil
+}
+
+// recordCheckResult сохраняет результат проверки и обновляет состояние прокси
+func (pm *ProxyManager) recordCheckResult(p *Proxy, latency time.Duration, checkErr error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	p.LastCheck = time.Now()
+	if checkErr == nil {
+		p.setHealth(HealthHealthy)
+		p.CheckLatency = latency
+		p.CheckFailures = 0
+		p.LastCheckErr = ""
+		return
+	}
+
+	p.CheckFailures++
+	p.LastCheckErr = checkErr.Error()
+	if p.CheckFailures >= pm.config.CheckFailures {
+		if p.Health() != HealthUnhealthy {
+			log.Printf("Прокси %s:%d помечен как нерабочий: %v", p.Host, p.Port, checkErr)
+		}
+		p.setHealth(HealthUnhealthy)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestForwardProxy запускает HTTP-прокси, который устанавливает туннели
+// CONNECT и отвечает 204 на обычные запросы
+func newTestForwardProxy(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// closedAddr возвращает адрес, на котором никто не принимает соединения
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+// hostPort возвращает хост и порт адреса host:port
+func hostPort(t *testing.T, addr string) (string, int) {
+	t.Helper()
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var port int
+	fmt.Sscan(portText, &port)
+	return host, port
+}
+
+func TestRecordCheckResultTransitions(t *testing.T) {
+	pm := newTestProxyManager(t, map[string]interface{}{"check_failures": 2},
+		`[{"host":"10.0.0.1","port":1080,"weight":1}]`)
+	p := pm.proxies[0]
+	checkErr := errors.New("CONNECT: connection refused")
+
+	steps := []struct {
+		err      error
+		health   HealthState
+		failures int
+	}{
+		{checkErr, HealthUnknown, 1},
+		{checkErr, HealthUnhealthy, 2},
+		{checkErr, HealthUnhealthy, 3},
+		{nil, HealthHealthy, 0},
+		{checkErr, HealthHealthy, 1},
+		{checkErr, HealthUnhealthy, 2},
+		{nil, HealthHealthy, 0},
+	}
+	for i, step := range steps {
+		pm.recordCheckResult(p, 10*time.Millisecond, step.err)
+		if p.Health() != step.health || p.CheckFailures != step.failures {
+			t.Fatalf("шаг %d: состояние %v, неудач %d; ожидалось %v, %d",
+				i+1, p.Health(), p.CheckFailures, step.health, step.failures)
+		}
+		if step.err == nil && (p.LastCheckErr != "" || p.CheckLatency != 10*time.Millisecond) {
+			t.Fatalf("шаг %d: после успеха ошибка %q, задержка %v", i+1, p.LastCheckErr, p.CheckLatency)
+		}
+		if step.err != nil && p.LastCheckErr != step.err.Error() {
+			t.Fatalf("шаг %d: ошибка проверки %q", i+1, p.LastCheckErr)
+		}
+
+		got := pm.GetProxyForEndpoint("", nil)
+		if (got == nil) != (step.health == HealthUnhealthy) {
+			t.Fatalf("шаг %d: выдан прокси %v при состоянии %v", i+1, got, step.health)
+		}
+		if got != nil {
+			pm.ReleaseProxy(got)
+		}
+	}
+}
+
+func TestCheckAllProxies(t *testing.T) {
+	forward := newTestForwardProxy(t)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	goodHost, goodPort := hostPort(t, strings.TrimPrefix(forward.URL, "http://"))
+	deadHost, deadPort := hostPort(t, closedAddr(t))
+	pm := newTestProxyManager(t, map[string]interface{}{
+		"check_failures": 2,
+		"check_timeout":  2,
+		"check_target":   strings.TrimPrefix(target.URL, "http://"),
+		"check_url":      target.URL,
+	}, fmt.Sprintf(`[{"host":%q,"port":%d,"weight":1},{"host":%q,"port":%d,"weight":1}]`,
+		goodHost, goodPort, deadHost, deadPort))
+	good, dead := pm.proxies[0], pm.proxies[1]
+
+	pm.checkAllProxies()
+	if good.Health() != HealthHealthy || good.CheckLatency <= 0 {
+		t.Fatalf("рабочий прокси: %v, задержка %v, ошибка %q", good.Health(), good.CheckLatency, good.LastCheckErr)
+	}
+	if dead.Health() != HealthUnknown || dead.CheckFailures != 1 || !strings.HasPrefix(dead.LastCheckErr, "CONNECT ") {
+		t.Fatalf("нерабочий прокси после первой проверки: %v, неудач %d, ошибка %q",
+			dead.Health(), dead.CheckFailures, dead.LastCheckErr)
+	}
+
+	pm.checkAllProxies()
+	if dead.Health() != HealthUnhealthy {
+		t.Fatalf("нерабочий прокси после второй проверки: %v", dead.Health())
+	}
+	if n := pm.GetHealthyProxiesCount(); n != 1 {
+		t.Fatalf("рабочих прокси %d, ожидался 1", n)
+	}
+	for i := 0; i < 4; i++ {
+		p := pm.GetProxyForEndpoint("", nil)
+		if p != good {
+			t.Fatalf("выдан прокси %v вместо рабочего", p)
+		}
+		pm.ReleaseProxy(p)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Заголовки запроса, управляющие хеджированием. В вышестоящий сервер не передаются.
+const (
+	// HedgeHeader включает хеджирование: "race" — сразу через все прокси,
+	// число — задержка в миллисекундах перед каждой следующей попыткой,
+	// "off" — отключает хеджирование, заданное для эндпоинта
+	HedgeHeader = "X-Proxy-Hedge"
+	// HedgeCountHeader задает количество дополнительных прокси
+	HedgeCountHeader = "X-Proxy-Hedge-Count"
+)
+
+// Режимы хеджирования
+const (
+	HedgeModeOff   = "off"   // Хеджирование отключено
+	HedgeModeDelay = "delay" // Следующая попытка запускается, если нет заголовков ответа за delay_ms
+	HedgeModeRace  = "race"  // Все попытки запускаются сразу
+)
+
+// HedgeConfig описывает хеджирование запросов к эндпоинту
+type HedgeConfig struct {
+	Mode    string `json:"mode"`               // off, delay или race
+	DelayMs int    `json:"delay_ms,omitempty"` // Задержка перед следующей попыткой (по умолчанию hedge_delay_ms)
+	Count   int    `json:"count,omitempty"`    // Количество дополнительных прокси (по умолчанию hedge_count)
+}
+
+// hedgePolicy — итоговые параметры хеджирования для конкретного запроса
+type hedgePolicy struct {
+	race  bool
+	delay time.Duration
+	count int
+}
+
+// hedgeResult — результат одной попытки хеджированного запроса
+type hedgeResult struct {
+	index    int // Порядковый номер попытки (0 — основная)
+	proxy    *Proxy
+	resp     *http.Response
+	duration time.Duration
+	err      error
+}
+
+// resolveHedgePolicy определяет параметры хеджирования по настройкам
+// эндпоинта и заголовкам запроса. Заголовки управления удаляются из запроса.
+func (ps *ProxyServer) resolveHedgePolicy(r *http.Request, endpoint *Endpoint) (hedgePolicy, bool, error) {
+	mode := HedgeModeOff
+	delayMs := ps.config.HedgeDelayMs
+	count := ps.config.HedgeCount
+	if endpoint.Hedge != nil {
+		mode = endpoint.Hedge.Mode
+		if endpoint.Hedge.DelayMs > 0 {
+			delayMs = endpoint.Hedge.DelayMs
+		}
+		if endpoint.Hedge.Count > 0 {
+			count = endpoint.Hedge.Count
+		}
+	}
+
+	if value := strings.TrimSpace(r.Header.Get(HedgeHeader)); value != "" {
+		switch strings.ToLower(value) {
+		case HedgeModeOff, HedgeModeRace:
+			mode = strings.ToLower(value)
+		default:
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms < 0 {
+				return hedgePolicy{}, false, fmt.Errorf("некорректное значение %s: %q", HedgeHeader, value)
+			}
+			mode = HedgeModeDelay
+			delayMs = ms
+		}
+	}
+	if value := strings.TrimSpace(r.Header.Get(HedgeCountHeader)); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return hedgePolicy{}, false, fmt.Errorf("некорректное значение %s: %q", HedgeCountHeader, value)
+		}
+		count = n
+	}
+	r.Header.Del(HedgeHeader)
+	r.Header.Del(HedgeCountHeader)
+
+	if mode == HedgeModeOff || mode == "" || count <= 0 {
+		return hedgePolicy{}, false, nil
+	}
+	return hedgePolicy{
+		race:  mode == HedgeModeRace,
+		delay: time.Duration(delayMs) * time.Millisecond,
+		count: count,
+	}, true, nil
+}
+
+// forwardHedged отправляет запрос через несколько прокси и возвращает
+// первый успешный ответ. Дополнительная попытка запускается по истечении
+// задержки без заголовков ответа, сразу в режиме race или сразу после
+// неудачи одной из попыток. Остальные попытки отменяются.
+func (ps *ProxyServer) forwardHedged(ctx context.Context, r *http.Request, endpoint *Endpoint, body *requestBody, policy hedgePolicy) upstreamResult {
+	maxAttempts := policy.count + 1
+	results := make(chan hedgeResult, maxAttempts)
+	cancels := make([]context.CancelFunc, 0, maxAttempts)
+	tried := make(map[*Proxy]bool)
+	pending := 0
+
+	var acquireErr error
+	launch := func() bool {
+		if len(cancels) >= maxAttempts {
+			return false
+		}
+		var proxy *Proxy
+		if len(cancels) == 0 {
+			proxy, acquireErr = ps.acquireProxy(ctx, endpoint, tried)
+		} else {
+			proxy = ps.proxyManager.GetProxyForEndpoint(endpoint.Name, tried)
+		}
+		if proxy == nil {
+			return false
+		}
+		tried[proxy] = true
+
+		attemptCtx, cancel := context.WithCancel(ctx)
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		pending++
+		if index > 0 {
+			ps.metrics.IncrementHedges(endpoint.Name)
+		}
+
+		go func() {
+			resp, duration, err := ps.doUpstream(attemptCtx, proxy, r, endpoint, body)
+			results <- hedgeResult{index: index, proxy: proxy, resp: resp, duration: duration, err: err}
+		}()
+		return true
+	}
+
+	// Контекст попытки, чей ответ возвращается, отменяется вместе с ctx
+	keep := -1
+	defer func() {
+		for i, cancel := range cancels {
+			if i != keep {
+				cancel()
+			}
+		}
+	}()
+
+	if !launch() {
+		return upstreamResult{err: acquireErr}
+	}
+	if policy.race {
+		for launch() {
+		}
+	}
+
+	timer := time.NewTimer(policy.delay)
+	defer timer.Stop()
+
+	var winner, last *hedgeResult
+	for pending > 0 && winner == nil {
+		select {
+		case <-timer.C:
+			if launch() {
+				timer.Reset(policy.delay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil && !ps.shouldRetry(res.resp, nil) {
+				winner = &res
+				break
+			}
+
+			// Неудачная попытка: сразу запускаем следующую
+			if isCanceled(res.err) {
+				ps.proxyManager.AbandonProxyAttempt(res.proxy)
+			} else {
+				ps.proxyManager.IncrementProxyErrorCount(res.proxy.URL, attemptFailure(res.resp, res.err))
+			}
+			if last != nil {
+				ps.discardHedgeResult(endpoint, last)
+			}
+			last = &res
+			launch()
+		}
+	}
+
+	// Оставшиеся попытки отменяются при выходе, их прокси освобождаем в фоне
+	if pending > 0 {
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				res := <-results
+				ps.discardHedgeResult(endpoint, &res)
+			}
+		}(pending)
+	}
+
+	if winner == nil {
+		// Все попытки неудачны: возвращаем последний ответ, если он был
+		if last == nil {
+			return upstreamResult{err: fmt.Errorf("все попытки отменены")}
+		}
+		if last.err != nil {
+			ps.proxyManager.ReleaseProxy(last.proxy)
+			return upstreamResult{duration: last.duration, err: last.err}
+		}
+		keep = last.index
+		return upstreamResult{proxy: last.proxy, resp: last.resp, duration: last.duration}
+	}
+
+	if last != nil {
+		ps.discardHedgeResult(endpoint, last)
+	}
+	if winner.index > 0 {
+		ps.metrics.IncrementHedgeWins(endpoint.Name)
+	}
+
+	keep = winner.index
+	ps.proxyManager.RecordProxySuccess(winner.proxy.URL, winner.duration)
+	return upstreamResult{proxy: winner.proxy, resp: winner.resp, duration: winner.duration}
+}
+
+// discardHedgeResult закрывает ответ проигравшей попытки, учитывает
+// полученные впустую байты и освобождает прокси
+func (ps *ProxyServer) discardHedgeResult(endpoint *Endpoint, res *hedgeResult) {
+	if res.resp != nil {
+		n, _ := io.Copy(ioutil.Discard, res.resp.Body)
+		res.resp.Body.Close()
+		ps.metrics.AddHedgeWastedBytes(endpoint.Name, n)
+	}
+	// Исход отмененной или проигравшей попытки не учитывается; после
+	// учтенной ошибки автомат уже разомкнут, и освобождать нечего
+	ps.proxyManager.AbandonProxyAttempt(res.proxy)
+	ps.proxyManager.ReleaseProxy(res.proxy)
+}
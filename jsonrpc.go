@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// jsonRPCPeekSize — сколько байт потокового тела читается для поиска метода.
+// Прочитанное возвращается в поток, передача тела не прерывается.
+const jsonRPCPeekSize = 4096
+
+// jsonRPCBatchMethod — имя метода для пакетных запросов в метриках и маршрутах
+const jsonRPCBatchMethod = "batch"
+
+// rpcCall — метод и идентификатор JSON-RPC запроса
+type rpcCall struct {
+	Method string // Имя метода, для пакета — jsonRPCBatchMethod
+	ID     string // Идентификатор запроса в исходном JSON-представлении
+	Batch  int    // Количество вызовов в пакете, 0 — одиночный запрос
+}
+
+// inspectJSONRPC извлекает метод и идентификатор JSON-RPC запроса из тела.
+// Тело разбирается потоково и только до нахождения обоих полей, поэтому
+// для больших тел достаточно начала. Возвращает nil, если тело не похоже
+// на JSON-RPC.
+func inspectJSONRPC(r *http.Request, body *requestBody) *rpcCall {
+	if r.Method != http.MethodPost {
+		return nil
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "json") {
+		return nil
+	}
+
+	var data []byte
+	if body.replayable {
+		data = body.data
+	} else {
+		data = body.peek(jsonRPCPeekSize)
+	}
+
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) == 0 {
+		return nil
+	}
+	if trimmed[0] == '[' {
+		return inspectJSONRPCBatch(trimmed)
+	}
+	return inspectJSONRPCObject(json.NewDecoder(bytes.NewReader(trimmed)))
+}
+
+// inspectJSONRPCObject читает из decoder объект запроса, пропуская поля,
+// кроме method и id. Разбор прекращается, как только оба поля найдены.
+func inspectJSONRPCObject(decoder *json.Decoder) *rpcCall {
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil
+	}
+
+	call := &rpcCall{}
+	haveID := false
+	for decoder.More() && (call.Method == "" || !haveID) {
+		key, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			break
+		}
+		switch key {
+		case "method":
+			json.Unmarshal(value, &call.Method)
+		case "id":
+			call.ID = string(value)
+			haveID = true
+		}
+	}
+
+	if call.Method == "" {
+		return nil
+	}
+	return call
+}
+
+// inspectJSONRPCBatch подсчитывает вызовы пакетного запроса
+func inspectJSONRPCBatch(data []byte) *rpcCall {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.Token() // '['
+
+	call := &rpcCall{Method: jsonRPCBatchMethod}
+	for decoder.More() {
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			break
+		}
+		call.Batch++
+	}
+	if call.Batch == 0 {
+		return nil
+	}
+	return call
+}
+
+// peek возвращает до n первых байт потокового тела, не нарушая передачу:
+// прочитанное остается в начале потока
+func (b *requestBody) peek(n int) []byte {
+	prefix := make([]byte, n)
+	read, _ := io.ReadFull(b.stream, prefix)
+	prefix = prefix[:read]
+	b.stream = io.MultiReader(bytes.NewReader(prefix), b.stream)
+	return prefix
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Параметры гистограмм задержки со скользящими окнами. Корзины
+// логарифмически-линейные, как в HDR Histogram: каждый интервал [2^k, 2^(k+1))
+// микросекунд делится на latencySubBuckets равных частей, поэтому
+// относительная погрешность процентилей не превышает 1/latencySubBuckets.
+const (
+	latencySubBucketBits = 3
+	latencySubBuckets    = 1 << latencySubBucketBits
+	latencyMaxExponent   = 27 // Значения от 2^28 мкс (~4.5 мин) учитываются в последней корзине
+	latencyBucketCount   = (latencyMaxExponent - latencySubBucketBits + 2) * latencySubBuckets
+	latencyMaxValue      = 1<<(latencyMaxExponent+1) - 1
+
+	latencySlotWidth = time.Minute // Ширина ячейки скользящего окна
+	latencySlots     = 16          // Ячейки на 15 минут и текущая
+)
+
+// latencyWindow — скользящее окно отчета о задержке
+type latencyWindow struct {
+	Name  string
+	Slots int64 // Количество полных ячеек в окне, кроме текущей
+}
+
+// latencyWindows — окна отчета: каждое покрывает свою длительность и
+// заполненную часть текущей ячейки
+var latencyWindows = []latencyWindow{
+	{Name: "1m", Slots: int64(time.Minute / latencySlotWidth)},
+	{Name: "5m", Slots: int64(5 * time.Minute / latencySlotWidth)},
+	{Name: "15m", Slots: int64(15 * time.Minute / latencySlotWidth)},
+}
+
+// latencyQuantiles — процентили в отчете о задержке
+var latencyQuantiles = []struct {
+	Name     string
+	Quantile float64
+}{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p99", 0.99},
+	{"p99_9", 0.999},
+}
+
+// latencyBucket возвращает индекс корзины для значения в микросекундах
+func latencyBucket(us uint64) int {
+	if us > latencyMaxValue {
+		us = latencyMaxValue
+	}
+	if us < latencySubBuckets {
+		return int(us)
+	}
+	shift := bits.Len64(us) - 1 - latencySubBucketBits
+	return (shift+1)*latencySubBuckets + int(us>>uint(shift)) - latencySubBuckets
+}
+
+// latencyBucketHigh возвращает наибольшее значение (мкс), попадающее в корзину
+func latencyBucketHigh(index int) uint64 {
+	if index < latencySubBuckets {
+		return uint64(index)
+	}
+	shift := uint(index/latencySubBuckets - 1)
+	sub := uint64(index%latencySubBuckets + latencySubBuckets)
+	return (sub+1)<<shift - 1
+}
+
+// latencySlot — гистограмма задержки за одну ячейку окна. Плотная ячейка
+// хранит счетчики всех корзин и обновляется атомарно, без блокировок: она
+// используется для эндпоинтов, замеры которых идут от всех воркеров сразу.
+// Разреженная ячейка хранит только непустые корзины под мьютексом: у
+// большинства прокси замеры занимают лишь несколько корзин, а плотный
+// массив на каждую ячейку каждого прокси слишком дорог при десятках тысяч
+// прокси, при этом нагрузка на один прокси невелика.
+type latencySlot struct {
+	period int64  // Номер ячейки: время начала, деленное на latencySlotWidth
+	max    uint64 // Наибольшее значение (мкс), обновляется атомарно
+
+	dense *[latencyBucketCount]uint64 // Счетчики корзин плотной ячейки
+
+	mu     sync.Mutex
+	counts map[uint16]uint32 // Индекс корзины -> количество замеров (разреженная ячейка)
+}
+
+// observe учитывает значение us
+func (s *latencySlot) observe(us uint64) {
+	bucket := latencyBucket(us)
+	if s.dense != nil {
+		atomic.AddUint64(&s.dense[bucket], 1)
+	} else {
+		s.mu.Lock()
+		if s.counts == nil {
+			s.counts = make(map[uint16]uint32)
+		}
+		s.counts[uint16(bucket)]++
+		s.mu.Unlock()
+	}
+
+	for {
+		max := atomic.LoadUint64(&s.max)
+		if us <= max || atomic.CompareAndSwapUint64(&s.max, max, us) {
+			return
+		}
+	}
+}
+
+// forEach вызывает fn для каждой непустой корзины ячейки
+func (s *latencySlot) forEach(fn func(bucket int, n uint64)) {
+	if s.dense != nil {
+		for bucket := range s.dense {
+			if n := atomic.LoadUint64(&s.dense[bucket]); n > 0 {
+				fn(bucket, n)
+			}
+		}
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for bucket, n := range s.counts {
+		fn(int(bucket), uint64(n))
+	}
+}
+
+// addTo добавляет замеры ячейки к плотной гистограмме
+func (s *latencySlot) addTo(counts *[latencyBucketCount]uint64, total, max *uint64) {
+	s.forEach(func(bucket int, n uint64) {
+		counts[bucket] += n
+		*total += n
+	})
+	if m := atomic.LoadUint64(&s.max); m > *max {
+		*max = m
+	}
+}
+
+// reset удаляет замеры ячейки
+func (s *latencySlot) reset() {
+	if s.dense != nil {
+		for bucket := range s.dense {
+			atomic.StoreUint64(&s.dense[bucket], 0)
+		}
+	} else {
+		s.mu.Lock()
+		s.counts = nil
+		s.mu.Unlock()
+	}
+	atomic.StoreUint64(&s.max, 0)
+}
+
+// latencyRecorder хранит гистограммы задержки за последние 15 минут в
+// кольце ячеек. Ячейка создается при первом замере в ее периоде, поэтому
+// регистратор без трафика почти не занимает памяти.
+type latencyRecorder struct {
+	dense bool // Плотные ячейки с атомарными счетчиками
+
+	mu    sync.Mutex
+	slots [latencySlots]atomic.Value // *latencySlot
+}
+
+// newLatencyRecorder создает пустой регистратор задержки с разреженными
+// ячейками (для прокси)
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{}
+}
+
+// newDenseLatencyRecorder создает пустой регистратор задержки с плотными
+// ячейками (для эндпоинтов)
+func newDenseLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{dense: true}
+}
+
+// latencyPeriod возвращает номер ячейки для момента t
+func latencyPeriod(t time.Time) int64 {
+	return t.UnixNano() / int64(latencySlotWidth)
+}
+
+// Observe учитывает задержку d
+func (lr *latencyRecorder) Observe(d time.Duration) {
+	lr.observeAt(time.Now(), d)
+}
+
+// observeAt учитывает задержку d в ячейке момента now
+func (lr *latencyRecorder) observeAt(now time.Time, d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	lr.slot(latencyPeriod(now)).observe(uint64(d / time.Microsecond))
+}
+
+// newSlot создает пустую ячейку периода period
+func (lr *latencyRecorder) newSlot(period int64) *latencySlot {
+	s := &latencySlot{period: period}
+	if lr.dense {
+		s.dense = new([latencyBucketCount]uint64)
+	}
+	return s
+}
+
+// slot возвращает ячейку периода period, заменяя устаревшую
+func (lr *latencyRecorder) slot(period int64) *latencySlot {
+	cell := &lr.slots[period%latencySlots]
+	if s, ok := cell.Load().(*latencySlot); ok && s.period >= period {
+		return s
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if s, ok := cell.Load().(*latencySlot); ok && s.period >= period {
+		return s
+	}
+	s := lr.newSlot(period)
+	cell.Store(s)
+	return s
+}
+
+// Reset удаляет все замеры, очищая уже созданные ячейки
+func (lr *latencyRecorder) Reset() {
+	for i := range lr.slots {
+		if s, ok := lr.slots[i].Load().(*latencySlot); ok {
+			s.reset()
+		}
+	}
+}
+
+// savedLatencySlot — ячейка окна задержки в файле состояния.
+// Хранятся только непустые корзины: индекс -> количество замеров.
+type savedLatencySlot struct {
+	Period int64          `json:"period"`
+	MaxUs  uint64         `json:"max_us"`
+	Counts map[int]uint32 `json:"counts"`
+}
+
+// save возвращает непустые ячейки, еще попадающие в окна
+func (lr *latencyRecorder) save() []savedLatencySlot {
+	return lr.saveAt(time.Now())
+}
+
+// saveAt возвращает непустые ячейки, попадающие в окна на момент now
+func (lr *latencyRecorder) saveAt(now time.Time) []savedLatencySlot {
+	current := latencyPeriod(now)
+	var saved []savedLatencySlot
+	for i := range lr.slots {
+		s, ok := lr.slots[i].Load().(*latencySlot)
+		if !ok || current-s.period >= latencySlots {
+			continue
+		}
+		counts := make(map[int]uint32)
+		s.forEach(func(bucket int, n uint64) {
+			counts[bucket] = uint32(n)
+		})
+		if len(counts) > 0 {
+			saved = append(saved, savedLatencySlot{Period: s.period, MaxUs: atomic.LoadUint64(&s.max), Counts: counts})
+		}
+	}
+	return saved
+}
+
+// restore добавляет сохраненные ячейки, которые еще попадают в окна.
+// Ячейки, уже заполненные после запуска, не заменяются.
+func (lr *latencyRecorder) restore(saved []savedLatencySlot) {
+	lr.restoreAt(time.Now(), saved)
+}
+
+// restoreAt добавляет сохраненные ячейки, попадающие в окна на момент now
+func (lr *latencyRecorder) restoreAt(now time.Time, saved []savedLatencySlot) {
+	current := latencyPeriod(now)
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	for _, slot := range saved {
+		if slot.Period > current || current-slot.Period >= latencySlots {
+			continue
+		}
+		cell := &lr.slots[slot.Period%latencySlots]
+		if s, ok := cell.Load().(*latencySlot); ok && s.period >= slot.Period {
+			continue
+		}
+		s := lr.newSlot(slot.Period)
+		s.max = slot.MaxUs
+		for i, n := range slot.Counts {
+			if i < 0 || i >= latencyBucketCount {
+				continue
+			}
+			if s.dense != nil {
+				s.dense[i] = uint64(n)
+			} else {
+				if s.counts == nil {
+					s.counts = make(map[uint16]uint32, len(slot.Counts))
+				}
+				s.counts[uint16(i)] = n
+			}
+		}
+		cell.Store(s)
+	}
+}
+
+// LatencySummary — процентили задержки за окно (миллисекунды)
+type LatencySummary struct {
+	Count       uint64             `json:"count"`
+	Max         float64            `json:"max_ms"`
+	Percentiles map[string]float64 `json:"percentiles_ms"`
+}
+
+// Summary возвращает процентили и максимум задержки для каждого окна
+// latencyWindows. Окна без замеров не включаются. Окна вложены друг в
+// друга, поэтому ячейки суммируются один раз, от новых к старым.
+func (lr *latencyRecorder) Summary() map[string]LatencySummary {
+	return lr.summaryAt(time.Now())
+}
+
+// summaryAt возвращает отчет о задержке на момент now
+func (lr *latencyRecorder) summaryAt(now time.Time) map[string]LatencySummary {
+	current := latencyPeriod(now)
+	var slots []*latencySlot
+	for i := range lr.slots {
+		if s, ok := lr.slots[i].Load().(*latencySlot); ok && current-s.period < latencySlots {
+			slots = append(slots, s)
+		}
+	}
+	result := make(map[string]LatencySummary, len(latencyWindows))
+	if len(slots) == 0 {
+		return result
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].period > slots[j].period })
+
+	var counts [latencyBucketCount]uint64
+	var total, max uint64
+	next := 0
+	for _, window := range latencyWindows {
+		for ; next < len(slots) && current-slots[next].period <= window.Slots; next++ {
+			slots[next].addTo(&counts, &total, &max)
+		}
+		if total == 0 {
+			continue
+		}
+
+		summary := LatencySummary{
+			Count:       total,
+			Max:         float64(max) / 1000,
+			Percentiles: make(map[string]float64, len(latencyQuantiles)),
+		}
+		for _, q := range latencyQuantiles {
+			summary.Percentiles[q.Name] = float64(percentile(counts[:], total, q.Quantile, max)) / 1000
+		}
+		result[window.Name] = summary
+	}
+	return result
+}
+
+// percentile возвращает значение (мкс), не меньше которого доля q замеров.
+// Значение корзины берется по верхней границе, но не больше максимума.
+func percentile(counts []uint64, total uint64, q float64, max uint64) uint64 {
+	rank := uint64(math.Ceil(q * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range counts {
+		seen += n
+		if seen >= rank {
+			if high := latencyBucketHigh(i); high < max {
+				return high
+			}
+			return max
+		}
+	}
+	return max
+}
+
+// latencyRecorders — регистраторы задержки с плотными ячейками, создаваемые
+// по ключу при первом обращении
+type latencyRecorders struct {
+	recorders sync.Map // ключ -> *latencyRecorder
+}
+
+// Observe учитывает задержку d для ключа key
+func (lrs *latencyRecorders) Observe(key string, d time.Duration) {
+	lr, ok := lrs.recorders.Load(key)
+	if !ok {
+		lr, _ = lrs.recorders.LoadOrStore(key, newDenseLatencyRecorder())
+	}
+	lr.(*latencyRecorder).Observe(d)
+}
+
+// Summary возвращает процентили задержки по ключам
+func (lrs *latencyRecorders) Summary() map[string]map[string]LatencySummary {
+	result := make(map[string]map[string]LatencySummary)
+	lrs.recorders.Range(func(key, value interface{}) bool {
+		if summary := value.(*latencyRecorder).Summary(); len(summary) > 0 {
+			result[key.(string)] = summary
+		}
+		return true
+	})
+	return result
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// latencyTestStart — начало ячейки окна, от которого отсчитываются замеры в тестах
+var latencyTestStart = time.Unix(1699999980, 0)
+
+func TestLatencyBucketPrecision(t *testing.T) {
+	for i := 0; i < latencyBucketCount; i++ {
+		if got := latencyBucket(latencyBucketHigh(i)); got != i {
+			t.Fatalf("latencyBucket(latencyBucketHigh(%d)) = %d", i, got)
+		}
+	}
+
+	prev := 0
+	for us := uint64(0); us <= latencyMaxValue; us += us/97 + 1 {
+		bucket := latencyBucket(us)
+		if bucket < prev || bucket >= latencyBucketCount {
+			t.Fatalf("latencyBucket(%d) = %d, предыдущая корзина %d", us, bucket, prev)
+		}
+		prev = bucket
+
+		high := latencyBucketHigh(bucket)
+		if high < us {
+			t.Fatalf("верхняя граница корзины %d для %d мкс меньше значения: %d", bucket, us, high)
+		}
+		if us >= latencySubBuckets && float64(high-us) > float64(us)/latencySubBuckets {
+			t.Fatalf("погрешность для %d мкс: верхняя граница %d", us, high)
+		}
+	}
+
+	if got := latencyBucket(latencyMaxValue * 4); got != latencyBucketCount-1 {
+		t.Fatalf("значение за пределом диапазона попало в корзину %d", got)
+	}
+}
+
+func TestLatencyQuantiles(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		recorder *latencyRecorder
+	}{
+		{"sparse", newLatencyRecorder()},
+		{"dense", newDenseLatencyRecorder()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for ms := 1; ms <= 1000; ms++ {
+				tc.recorder.observeAt(latencyTestStart, time.Duration(ms)*time.Millisecond)
+			}
+
+			summary, ok := tc.recorder.summaryAt(latencyTestStart)["1m"]
+			if !ok {
+				t.Fatal("нет окна 1m")
+			}
+			if summary.Count != 1000 {
+				t.Fatalf("count = %d, ожидалось 1000", summary.Count)
+			}
+			if summary.Max != 1000 {
+				t.Fatalf("max = %g, ожидалось 1000", summary.Max)
+			}
+			for name, exact := range map[string]float64{"p50": 500, "p90": 900, "p99": 990, "p99_9": 999} {
+				got := summary.Percentiles[name]
+				if got < exact || got > exact*(1+1.0/latencySubBuckets) {
+					t.Errorf("%s = %g, ожидалось от %g до %g", name, got, exact, exact*(1+1.0/latencySubBuckets))
+				}
+			}
+		})
+	}
+}
+
+func TestLatencyWindowRollover(t *testing.T) {
+	lr := newLatencyRecorder()
+	for i := 0; i < 10; i++ {
+		lr.observeAt(latencyTestStart, time.Millisecond)
+		lr.observeAt(latencyTestStart.Add(3*time.Minute), 100*time.Millisecond)
+	}
+
+	counts := func(now time.Time) map[string]uint64 {
+		result := make(map[string]uint64)
+		for name, summary := range lr.summaryAt(now) {
+			result[name] = summary.Count
+		}
+		return result
+	}
+	expect := func(now time.Time, want map[string]uint64) {
+		t.Helper()
+		got := counts(now)
+		if len(got) != len(want) {
+			t.Fatalf("окна на %v: %v, ожидалось %v", now.Sub(latencyTestStart), got, want)
+		}
+		for name, n := range want {
+			if got[name] != n {
+				t.Fatalf("окна на %v: %v, ожидалось %v", now.Sub(latencyTestStart), got, want)
+			}
+		}
+	}
+
+	expect(latencyTestStart.Add(3*time.Minute), map[string]uint64{"1m": 10, "5m": 20, "15m": 20})
+	expect(latencyTestStart.Add(10*time.Minute), map[string]uint64{"15m": 20})
+	expect(latencyTestStart.Add(16*time.Minute), map[string]uint64{"15m": 10})
+	expect(latencyTestStart.Add(19*time.Minute), map[string]uint64{})
+
+	// Ячейка первого периода переиспользуется через latencySlots периодов
+	lr.observeAt(latencyTestStart.Add(latencySlots*time.Minute), 5*time.Millisecond)
+	expect(latencyTestStart.Add(latencySlots*time.Minute), map[string]uint64{"1m": 1, "5m": 1, "15m": 11})
+	if max := lr.summaryAt(latencyTestStart.Add(latencySlots * time.Minute))["1m"].Max; max != 5 {
+		t.Fatalf("max в новой ячейке = %g, ожидалось 5", max)
+	}
+}
+
+func TestLatencyConcurrentObserve(t *testing.T) {
+	lr := newDenseLatencyRecorder()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				lr.observeAt(latencyTestStart, time.Duration(w*1000+i)*time.Microsecond)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	summary := lr.summaryAt(latencyTestStart)["1m"]
+	if summary.Count != 8000 {
+		t.Fatalf("count = %d, ожидалось 8000", summary.Count)
+	}
+	if summary.Max != 7.999 {
+		t.Fatalf("max = %g, ожидалось 7.999", summary.Max)
+	}
+}
+
+func TestLatencyReset(t *testing.T) {
+	for _, lr := range []*latencyRecorder{newLatencyRecorder(), newDenseLatencyRecorder()} {
+		lr.observeAt(latencyTestStart, time.Second)
+		lr.Reset()
+		if summary := lr.summaryAt(latencyTestStart); len(summary) != 0 {
+			t.Fatalf("после Reset остались замеры: %v", summary)
+		}
+		lr.observeAt(latencyTestStart, time.Millisecond)
+		if max := lr.summaryAt(latencyTestStart)["1m"].Max; max != 1 {
+			t.Fatalf("max после Reset = %g, ожидалось 1", max)
+		}
+	}
+}
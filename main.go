@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -13,6 +15,11 @@ import (
 )
 
 func main() {
+	// Подкоманда replay: повторная отправка захваченных запросов
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
 	// Парсим флаги командной строки
 	configFile := flag.String("config", "config.json", "Путь к файлу конфигурации")
 	flag.Parse()
@@ -32,14 +39,32 @@ func main() {
 		log.Fatalf("Ошибка создания менеджера прокси: %v", err)
 	}
 
+	// Запускаем фоновую проверку прокси, отслеживание изменений файла прокси
+	// и периодическое сохранение статистики
+	proxyManager.StartHealthChecker()
+	proxyManager.StartReloadWatcher()
+	proxyManager.StartStateSaver()
+
+	// Создаем реестр эндпоинтов
+	endpoints, err := NewEndpointRegistry(config)
+	if err != nil {
+		log.Fatalf("Ошибка загрузки эндпоинтов: %v", err)
+	}
+
 	// Создаем систему метрик
-	metrics := NewMetrics(proxyManager)
+	metrics := NewMetrics(proxyManager, endpoints)
 
 	// Запускаем сервер метрик
 	metrics.StartMetricsServer(config.MetricsAddr)
 
+	// Открываем журнал запросов
+	accessLog, err := NewAccessLogger(config)
+	if err != nil {
+		log.Fatalf("Ошибка открытия журнала запросов: %v", err)
+	}
+
 	// Создаем прокси сервер
-	server := NewProxyServer(config, proxyManager, metrics)
+	server := NewProxyServer(config, proxyManager, metrics, endpoints, accessLog)
 
 	// Запускаем периодическую сборку мусора
 	go func() {
@@ -50,13 +75,32 @@ func main() {
 		}
 	}()
 
+	// Перезагружаем эндпоинты и список прокси по SIGHUP
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	go func() {
+		for range reloadCh {
+			log.Printf("Получен SIGHUP, перезагрузка эндпоинтов и списка прокси")
+			if newConfig, err := LoadConfig(*configFile); err != nil {
+				log.Printf("Ошибка загрузки конфигурации: %v", err)
+			} else if err := endpoints.Update(newConfig.Endpoints, newConfig.EndpointGroups); err != nil {
+				log.Printf("Ошибка перезагрузки эндпоинтов: %v", err)
+			} else {
+				log.Printf("Эндпоинты перезагружены: %v", endpoints.Names())
+			}
+			if err := proxyManager.Reload(); err != nil {
+				log.Printf("Ошибка перезагрузки прокси: %v", err)
+			}
+		}
+	}()
+
 	// Обрабатываем сигналы завершения
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
 
 	// Запускаем прокси сервер в отдельной горутине
 	go func() {
-		if err := server.Start(); err != nil {
+		if err := server.Start(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Ошибка запуска прокси сервера: %v", err)
 		}
 	}()
@@ -67,4 +111,19 @@ func main() {
 	// Ожидаем сигнала завершения
 	sig := <-signalCh
 	fmt.Printf("Получен сигнал %v, завершение работы...\n", sig)
+
+	// Повторный сигнал прерывает ожидание
+	go func() {
+		sig := <-signalCh
+		log.Printf("Получен повторный сигнал %v, немедленное завершение", sig)
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Ошибка остановки сервера: %v", err)
+		cancel()
+		os.Exit(1)
+	}
 }
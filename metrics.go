@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,26 +15,50 @@ import (
 
 // Metrics содержит метрики прокси сервера
 type Metrics struct {
-	TotalRequests      uint64        // Общее количество запросов
-	SuccessfulRequests uint64        // Успешные запросы
-	FailedRequests     uint64        // Неудачные запросы
-	ActiveConnections  int32         // Активные соединения
-	ProxyManager       *ProxyManager // Менеджер прокси
-	StartTime          time.Time     // Время запуска сервера
-
-	// Для статистики времени отклика
-	responseTimes      []time.Duration // Список времен отклика
-	responseTimesMutex sync.Mutex      // Мьютекс для доступа к списку
-	maxResponseTimes   int             // Максимальный размер списка
+	TotalRequests      uint64            // Общее количество запросов
+	SuccessfulRequests uint64            // Успешные запросы
+	FailedRequests     uint64            // Неудачные запросы
+	ActiveConnections  int32             // Активные соединения
+	ProxyManager       *ProxyManager     // Менеджер прокси
+	Endpoints          *EndpointRegistry // Карта эндпоинтов
+	StartTime          time.Time         // Время запуска сервера
+
+	// Счетчики по эндпоинтам
+	retries          counterMap // Повторы через другой прокси
+	hedges           counterMap // Дополнительные (хеджирующие) попытки
+	hedgeWins        counterMap // Ответы, полученные через хеджирующую попытку
+	hedgeWastedBytes counterMap // Байты ответов отмененных и проигравших попыток
+	failovers        counterMap // Переключения с эндпоинта на резервный
+	rateLimited      counterMap // Запросы, отклоненные из-за исчерпания лимита у всех прокси
+
+	// Исходы попыток запроса к эндпоинтам
+	transportErrors  counterMap    // Ошибки соединения через прокси и таймауты
+	upstreamErrors   counterMap    // Ответы 4xx/5xx и ошибки JSON-RPC
+	upstreamLimited  counterMap    // Ответы об ограничении частоты (429, ошибка JSON-RPC)
+	upstreamStatuses statusCounter // Гистограмма статусов ответа по эндпоинтам
+
+	// Счетчики по методам JSON-RPC
+	rpcRequests counterMap   // Запросы
+	rpcErrors   counterMap   // Ошибки соединения и ответы со статусом 4xx/5xx
+	rpcTimes    histogramMap // Время ответа
+
+	// Время ответа на запросы: общее, по эндпоинтам и по группам для
+	// сводной рассылки, где время определяется самым медленным эндпоинтом
+	responseTimes   *histogram
+	endpointTimes   histogramMap
+	groupTimes      histogramMap
+	endpointLatency latencyRecorders // Процентили за скользящие окна
+
+	server *http.Server // Сервер метрик
 }
 
 // NewMetrics создает новый объект метрик
-func NewMetrics(pm *ProxyManager) *Metrics {
+func NewMetrics(pm *ProxyManager, endpoints *EndpointRegistry) *Metrics {
 	return &Metrics{
-		ProxyManager:     pm,
-		StartTime:        time.Now(),
-		maxResponseTimes: 1000,
-		responseTimes:    make([]time.Duration, 0, 1000),
+		ProxyManager:  pm,
+		Endpoints:     endpoints,
+		StartTime:     time.Now(),
+		responseTimes: newHistogram(),
 	}
 }
 
@@ -61,41 +87,163 @@ func (m *Metrics) DecrementActiveConnections() {
 	atomic.AddInt32(&m.ActiveConnections, -1)
 }
 
-// GetActiveConnections возвращает количество активных соединений
-func (m *Metrics) GetActiveConnections() int32 {
-	return atomic.LoadInt32(&m.ActiveConnections)
+// statusCounter — счетчики статусов ответа по эндпоинтам
+type statusCounter struct {
+	endpoints sync.Map // эндпоинт -> *counterMap
+}
+
+// Add учитывает ответ со статусом status
+func (s *statusCounter) Add(endpoint string, status int) {
+	v, ok := s.endpoints.Load(endpoint)
+	if !ok {
+		v, _ = s.endpoints.LoadOrStore(endpoint, &counterMap{})
+	}
+	v.(*counterMap).Add(strconv.Itoa(status), 1)
+}
+
+// Snapshot возвращает текущие значения счетчиков
+func (s *statusCounter) Snapshot() map[string]map[string]uint64 {
+	result := make(map[string]map[string]uint64)
+	s.endpoints.Range(func(key, value interface{}) bool {
+		result[key.(string)] = value.(*counterMap).Snapshot()
+		return true
+	})
+	return result
 }
 
-// RecordResponseTime записывает время ответа с ограничением размера
-func (m *Metrics) RecordResponseTime(duration time.Duration) {
-	m.responseTimesMutex.Lock()
-	defer m.responseTimesMutex.Unlock()
+// counterMap — набор атомарных счетчиков, создаваемых по ключу при первом обращении
+type counterMap struct {
+	counters sync.Map // ключ -> *uint64
+}
 
-	// Если размер превышает лимит, удаляем старые записи
-	if len(m.responseTimes) >= m.maxResponseTimes {
-		// Удаляем 10% старых записей
-		removeCount := m.maxResponseTimes / 10
-		m.responseTimes = m.responseTimes[removeCount:]
+// Add увеличивает счетчик key на delta
+func (c *counterMap) Add(key string, delta uint64) {
+	counter, ok := c.counters.Load(key)
+	if !ok {
+		counter, _ = c.counters.LoadOrStore(key, new(uint64))
 	}
+	atomic.AddUint64(counter.(*uint64), delta)
+}
 
-	m.responseTimes = append(m.responseTimes, duration)
+// Snapshot возвращает текущие значения всех счетчиков
+func (c *counterMap) Snapshot() map[string]uint64 {
+	stats := make(map[string]uint64)
+	c.counters.Range(func(key, value interface{}) bool {
+		stats[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+	return stats
 }
 
-// GetAverageResponseTime возвращает среднее время ответа в миллисекундах
-func (m *Metrics) GetAverageResponseTime() float64 {
-	m.responseTimesMutex.Lock()
-	defer m.responseTimesMutex.Unlock()
+// IncrementRetries учитывает повтор запроса к эндпоинту через другой прокси
+func (m *Metrics) IncrementRetries(endpoint string) {
+	m.retries.Add(endpoint, 1)
+}
+
+// IncrementHedges учитывает запуск хеджирующей попытки запроса к эндпоинту
+func (m *Metrics) IncrementHedges(endpoint string) {
+	m.hedges.Add(endpoint, 1)
+}
+
+// IncrementHedgeWins учитывает ответ, полученный через хеджирующую попытку
+func (m *Metrics) IncrementHedgeWins(endpoint string) {
+	m.hedgeWins.Add(endpoint, 1)
+}
 
-	if len(m.responseTimes) == 0 {
-		return 0
+// AddHedgeWastedBytes учитывает байты, полученные отмененными попытками
+func (m *Metrics) AddHedgeWastedBytes(endpoint string, n int64) {
+	if n > 0 {
+		m.hedgeWastedBytes.Add(endpoint, uint64(n))
 	}
+}
+
+// IncrementFailovers учитывает переключение запроса с эндпоинта на резервный
+func (m *Metrics) IncrementFailovers(endpoint string) {
+	m.failovers.Add(endpoint, 1)
+}
+
+// IncrementRateLimited учитывает запрос, для которого не нашлось прокси
+// со свободным лимитом запросов к эндпоинту
+func (m *Metrics) IncrementRateLimited(endpoint string) {
+	m.rateLimited.Add(endpoint, 1)
+}
+
+// IncrementTransportErrors учитывает попытку, не получившую ответа
+func (m *Metrics) IncrementTransportErrors(endpoint string) {
+	m.transportErrors.Add(endpoint, 1)
+}
+
+// RecordUpstreamResponse учитывает статус и класс ответа вышестоящего сервера
+func (m *Metrics) RecordUpstreamResponse(endpoint string, status int, class upstreamClass) {
+	m.upstreamStatuses.Add(endpoint, status)
+	switch class {
+	case UpstreamError:
+		m.upstreamErrors.Add(endpoint, 1)
+	case UpstreamRateLimited:
+		m.upstreamLimited.Add(endpoint, 1)
+	}
+}
+
+// RecordRPC учитывает JSON-RPC запрос: метод, время ответа и исход
+func (m *Metrics) RecordRPC(method string, duration time.Duration, failed bool) {
+	m.rpcRequests.Add(method, 1)
+	m.rpcTimes.Observe(method, duration)
+	if failed {
+		m.rpcErrors.Add(method, 1)
+	}
+}
+
+// rpcSnapshot возвращает метрики по методам JSON-RPC
+func (m *Metrics) rpcSnapshot() map[string]interface{} {
+	requests := m.rpcRequests.Snapshot()
+	errors := m.rpcErrors.Snapshot()
+
+	result := make(map[string]interface{}, len(requests))
+	for method, count := range requests {
+		entry := map[string]interface{}{
+			"requests": count,
+			"errors":   errors[method],
+		}
+		if h, ok := m.rpcTimes.Get(method); ok {
+			entry["average_response_ms"] = h.MeanMs()
+		}
+		result[method] = entry
+	}
+	return result
+}
 
-	var total time.Duration
-	for _, d := range m.responseTimes {
-		total += d
+// GetActiveConnections возвращает количество активных соединений
+func (m *Metrics) GetActiveConnections() int32 {
+	return atomic.LoadInt32(&m.ActiveConnections)
+}
+
+// RecordResponseTime учитывает время ответа на запрос к эндпоинту
+func (m *Metrics) RecordResponseTime(endpoint string, duration time.Duration) {
+	m.responseTimes.Observe(duration)
+	m.endpointTimes.Observe(endpoint, duration)
+	m.endpointLatency.Observe(endpoint, duration)
+}
+
+// RecordGroupTime учитывает время сводного ответа на рассылку по группе
+func (m *Metrics) RecordGroupTime(group string, duration time.Duration) {
+	m.responseTimes.Observe(duration)
+	m.groupTimes.Observe(group, duration)
+}
+
+// groupSnapshot возвращает среднее время сводного ответа по группам
+func (m *Metrics) groupSnapshot() map[string]float64 {
+	result := make(map[string]float64)
+	for _, group := range m.groupTimes.Keys() {
+		if h, ok := m.groupTimes.Get(group); ok {
+			result[group] = h.MeanMs()
+		}
 	}
+	return result
+}
 
-	return float64(total.Milliseconds()) / float64(len(m.responseTimes))
+// GetAverageResponseTime возвращает среднее время ответа в миллисекундах
+func (m *Metrics) GetAverageResponseTime() float64 {
+	return m.responseTimes.MeanMs()
 }
 
 // StartMemoryMonitor запускает мониторинг памяти
@@ -115,6 +263,67 @@ func (m *Metrics) StartMemoryMonitor() {
 	}()
 }
 
+// handleJSON отдает метрики в формате JSON
+func (m *Metrics) handleJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	uptime := time.Since(m.StartTime)
+
+	metrics := map[string]interface{}{
+		"total_requests":      atomic.LoadUint64(&m.TotalRequests),
+		"successful_requests": atomic.LoadUint64(&m.SuccessfulRequests),
+		"failed_requests":     atomic.LoadUint64(&m.FailedRequests),
+		"active_connections":  atomic.LoadInt32(&m.ActiveConnections),
+		"total_proxies":       m.ProxyManager.GetTotalProxiesCount(),
+		"healthy_proxies":     m.ProxyManager.GetHealthyProxiesCount(),
+		"circuit_breakers":    m.ProxyManager.GetCircuitStats(),
+		"retries":             m.retries.Snapshot(),
+		"hedging": map[string]interface{}{
+			"hedges":       m.hedges.Snapshot(),
+			"wins":         m.hedgeWins.Snapshot(),
+			"wasted_bytes": m.hedgeWastedBytes.Snapshot(),
+		},
+		"uptime_seconds":      int(uptime.Seconds()),
+		"uptime_human":        formatUptime(uptime),
+		"requests_per_second": float64(atomic.LoadUint64(&m.TotalRequests)) / uptime.Seconds(),
+		"average_response_ms": m.GetAverageResponseTime(),
+		"memory_alloc_mb":     ms.Alloc / 1024 / 1024,
+		"memory_sys_mb":       ms.Sys / 1024 / 1024,
+		"num_goroutines":      runtime.NumGoroutine(),
+		"num_gc":              ms.NumGC,
+	}
+
+	// Добавляем информацию о доступных эндпоинтах и их здоровье
+	metrics["endpoints"] = m.Endpoints.Names()
+	metrics["endpoint_health"] = m.Endpoints.health.Snapshot(m.Endpoints.Names())
+	metrics["endpoint_latency_ms"] = m.Endpoints.Latencies()
+	metrics["latency"] = m.endpointLatency.Summary()
+	metrics["group_response_ms"] = m.groupSnapshot()
+	metrics["failovers"] = m.failovers.Snapshot()
+	metrics["rate_limited"] = m.rateLimited.Snapshot()
+	metrics["upstream"] = map[string]interface{}{
+		"transport_errors": m.transportErrors.Snapshot(),
+		"upstream_errors":  m.upstreamErrors.Snapshot(),
+		"rate_limited":     m.upstreamLimited.Snapshot(),
+		"status_codes":     m.upstreamStatuses.Snapshot(),
+	}
+	metrics["jsonrpc_methods"] = m.rpcSnapshot()
+	if chain := m.Endpoints.AutoChain(); len(chain) > 0 {
+		metrics["auto_endpoint"] = chain[0].Name
+	}
+
+	jsonData, err := json.MarshalIndent(metrics, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonData)
+}
+
 // StartMetricsServer запускает HTTP-сервер для метрик
 func (m *Metrics) StartMetricsServer(addr string) {
 	// Запускаем мониторинг памяти
@@ -122,52 +331,28 @@ func (m *Metrics) StartMetricsServer(addr string) {
 
 	mux := http.NewServeMux()
 
-	// Эндпоинт для метрик в формате JSON
+	// Метрики в текстовом формате Prometheus, а по Accept: application/json
+	// или ?format=json — в прежнем формате JSON
 	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
-		var ms runtime.MemStats
-		runtime.ReadMemStats(&ms)
-
-		uptime := time.Since(m.StartTime)
-
-		metrics := map[string]interface{}{
-			"total_requests":      atomic.LoadUint64(&m.TotalRequests),
-			"successful_requests": atomic.LoadUint64(&m.SuccessfulRequests),
-			"failed_requests":     atomic.LoadUint64(&m.FailedRequests),
-			"active_connections":  atomic.LoadInt32(&m.ActiveConnections),
-			"total_proxies":       m.ProxyManager.GetTotalProxiesCount(),
-			"uptime_seconds":      int(uptime.Seconds()),
-			"uptime_human":        formatUptime(uptime),
-			"requests_per_second": float64(atomic.LoadUint64(&m.TotalRequests)) / uptime.Seconds(),
-			"average_response_ms": m.GetAverageResponseTime(),
-			"memory_alloc_mb":     ms.Alloc / 1024 / 1024,
-			"memory_sys_mb":       ms.Sys / 1024 / 1024,
-			"num_goroutines":      runtime.NumGoroutine(),
-			"num_gc":              ms.NumGC,
-		}
-
-		// Добавляем информацию о доступных эндпоинтах
-		endpoints := make([]string, 0, len(ENDPOINTS))
-		for name := range ENDPOINTS {
-			endpoints = append(endpoints, name)
-		}
-		metrics["endpoints"] = endpoints
-
-		jsonData, err := json.MarshalIndent(metrics, "", "  ")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if wantsJSON(r) {
+			m.handleJSON(w, r)
 			return
 		}
-
-		w.Write(jsonData)
+		m.handlePrometheus(w, r)
 	})
+	mux.HandleFunc("/metrics.json", m.handleJSON)
 
-	// Эндпоинт для информации о прокси
+	// Эндпоинт для информации о прокси: /proxies?sort=latency&limit=50,
+	// sort=-поле — по убыванию
 	mux.HandleFunc("/proxies", func(w http.ResponseWriter, r *http.Request) {
+		query, err := parseProxyStatsQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 
-		stats := m.ProxyManager.GetProxiesStats()
+		stats := m.ProxyManager.GetProxiesStats(query)
 
 		jsonData, err := json.MarshalIndent(stats, "", "  ")
 		if err != nil {
@@ -178,6 +363,11 @@ func (m *Metrics) StartMetricsServer(addr string) {
 		w.Write(jsonData)
 	})
 
+	// Управление списком прокси, доступно только при заданном admin_token
+	if token := m.ProxyManager.config.AdminToken; token != "" {
+		mux.HandleFunc("/admin/proxies", adminAuth(token, m.ProxyManager.handleAdminProxies))
+	}
+
 	// Эндпоинт для проверки работоспособности
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -185,14 +375,23 @@ func (m *Metrics) StartMetricsServer(addr string) {
 	})
 
 	// Запускаем HTTP-сервер для метрик в отдельной горутине
+	m.server = &http.Server{Addr: addr, Handler: mux}
 	go func() {
 		fmt.Printf("Сервер метрик запущен на %s\n", addr)
-		if err := http.ListenAndServe(addr, mux); err != nil {
+		if err := m.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			fmt.Printf("Ошибка запуска сервера метрик: %v\n", err)
 		}
 	}()
 }
 
+// Shutdown останавливает сервер метрик
+func (m *Metrics) Shutdown(ctx context.Context) error {
+	if m.server == nil {
+		return nil
+	}
+	return m.server.Shutdown(ctx)
+}
+
 // formatUptime форматирует время работы в человекочитаемом формате
 func formatUptime(d time.Duration) string {
 	days := int(d.Hours() / 24)
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Типы содержимого ответа /metrics
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// metricsPrefix — общий префикс имен метрик
+const metricsPrefix = "proxy_server_"
+
+// latencyBuckets — верхние границы корзин гистограмм времени ответа (секунды)
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// histogram — гистограмма времени ответа с фиксированными корзинами latencyBuckets
+type histogram struct {
+	sumUs  uint64   // Сумма наблюдений (мкс)
+	counts []uint64 // Наблюдения по корзинам, последняя — выше всех границ
+}
+
+// newHistogram создает пустую гистограмму
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+// Observe учитывает наблюдение d
+func (h *histogram) Observe(d time.Duration) {
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sumUs, uint64(d.Microseconds()))
+}
+
+// Snapshot возвращает накопительные значения корзин, сумму (секунды)
+// и количество наблюдений
+func (h *histogram) Snapshot() ([]uint64, float64, uint64) {
+	cumulative := make([]uint64, len(h.counts))
+	var count uint64
+	for i := range h.counts {
+		count += atomic.LoadUint64(&h.counts[i])
+		cumulative[i] = count
+	}
+	sum := float64(atomic.LoadUint64(&h.sumUs)) / 1e6
+	return cumulative, sum, count
+}
+
+// MeanMs возвращает среднее время ответа в миллисекундах
+func (h *histogram) MeanMs() float64 {
+	_, sum, count := h.Snapshot()
+	if count == 0 {
+		return 0
+	}
+	return sum * 1000 / float64(count)
+}
+
+// histogramMap — набор гистограмм, создаваемых по ключу при первом обращении
+type histogramMap struct {
+	histograms sync.Map // ключ -> *histogram
+}
+
+// Observe учитывает наблюдение d в гистограмме key
+func (hm *histogramMap) Observe(key string, d time.Duration) {
+	h, ok := hm.histograms.Load(key)
+	if !ok {
+		h, _ = hm.histograms.LoadOrStore(key, newHistogram())
+	}
+	h.(*histogram).Observe(d)
+}
+
+// Get возвращает гистограмму key, если в ней есть наблюдения
+func (hm *histogramMap) Get(key string) (*histogram, bool) {
+	h, ok := hm.histograms.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return h.(*histogram), true
+}
+
+// Keys возвращает ключи гистограмм в порядке сортировки
+func (hm *histogramMap) Keys() []string {
+	var keys []string
+	hm.histograms.Range(func(key, _ interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// promWriter формирует ответ в текстовом формате Prometheus или OpenMetrics
+type promWriter struct {
+	buf         bytes.Buffer
+	openMetrics bool
+}
+
+// family начинает семейство метрик: выводит описание и тип. В OpenMetrics
+// имя семейства счетчика указывается без суффикса _total.
+func (p *promWriter) family(name, kind, help string) {
+	if p.openMetrics && kind == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	p.buf.WriteString("# HELP " + metricsPrefix + name + " " + escapeHelp(help) + "\n")
+	p.buf.WriteString("# TYPE " + metricsPrefix + name + " " + kind + "\n")
+}
+
+// sample выводит значение метрики. labels — пары имя, значение.
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.buf.WriteString(metricsPrefix + name)
+	if len(labels) > 0 {
+		p.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.buf.WriteByte(',')
+			}
+			p.buf.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		}
+		p.buf.WriteByte('}')
+	}
+	p.buf.WriteString(" " + formatFloat(value) + "\n")
+}
+
+// counter выводит семейство из одного счетчика без меток
+func (p *promWriter) counter(name, help string, value uint64) {
+	p.family(name, "counter", help)
+	p.sample(name, float64(value))
+}
+
+// gauge выводит семейство из одного показателя без меток
+func (p *promWriter) gauge(name, help string, value float64) {
+	p.family(name, "gauge", help)
+	p.sample(name, value)
+}
+
+// counterMap выводит счетчики counterMap с ключом в метке label
+func (p *promWriter) counterMap(name, help, label string, c *counterMap) {
+	p.family(name, "counter", help)
+	values := c.Snapshot()
+	for _, key := range sortedKeys(values) {
+		p.sample(name, float64(values[key]), label, key)
+	}
+}
+
+// histograms выводит гистограммы histogramMap с ключом в метке label
+func (p *promWriter) histograms(name, help, label string, hm *histogramMap) {
+	p.family(name, "histogram", help)
+	for _, key := range hm.Keys() {
+		h, _ := hm.Get(key)
+		p.histogram(name, h, label, key)
+	}
+}
+
+// histogram выводит корзины, сумму и количество наблюдений гистограммы
+func (p *promWriter) histogram(name string, h *histogram, labels ...string) {
+	cumulative, sum, count := h.Snapshot()
+	for i, bound := range latencyBuckets {
+		p.sample(name+"_bucket", float64(cumulative[i]), append(labels, "le", formatFloat(bound))...)
+	}
+	p.sample(name+"_bucket", float64(count), append(labels, "le", "+Inf")...)
+	p.sample(name+"_sum", sum, labels...)
+	p.sample(name+"_count", float64(count), labels...)
+}
+
+// latencyWindows выводит процентили (метка quantile, для максимума — "1")
+// за скользящие окна (метка window) с ключом в метке label
+func (p *promWriter) latencyWindows(name, help, label string, summaries map[string]map[string]LatencySummary) {
+	p.family(name, "gauge", help)
+	keys := make([]string, 0, len(summaries))
+	for key := range summaries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, window := range latencyWindows {
+			summary, ok := summaries[key][window.Name]
+			if !ok {
+				continue
+			}
+			for _, q := range latencyQuantiles {
+				p.sample(name, summary.Percentiles[q.Name]/1000,
+					label, key, "window", window.Name, "quantile", formatFloat(q.Quantile))
+			}
+			p.sample(name, summary.Max/1000, label, key, "window", window.Name, "quantile", "1")
+		}
+	}
+}
+
+// Bytes завершает вывод и возвращает сформированный ответ
+func (p *promWriter) Bytes() []byte {
+	if p.openMetrics {
+		p.buf.WriteString("# EOF\n")
+	}
+	return p.buf.Bytes()
+}
+
+// formatFloat форматирует значение метрики
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escapeLabel экранирует значение метки
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// escapeHelp экранирует текст описания метрики
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// sortedKeys возвращает ключи карты счетчиков в порядке сортировки
+func sortedKeys(values map[string]uint64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statusClass возвращает класс статуса HTTP вида 2xx
+func statusClass(code string) string {
+	if len(code) != 3 {
+		return "other"
+	}
+	return code[:1] + "xx"
+}
+
+// wantsJSON сообщает, запрошены ли метрики в формате JSON
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// wantsOpenMetrics сообщает, запрошены ли метрики в формате OpenMetrics
+func wantsOpenMetrics(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "openmetrics" ||
+		strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+}
+
+// handlePrometheus отдает метрики в текстовом формате Prometheus или,
+// по заголовку Accept, OpenMetrics
+func (m *Metrics) handlePrometheus(w http.ResponseWriter, r *http.Request) {
+	p := &promWriter{openMetrics: wantsOpenMetrics(r)}
+	m.writePrometheus(p)
+
+	if p.openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", prometheusContentType)
+	}
+	w.Write(p.Bytes())
+}
+
+// writePrometheus выводит все метрики сервера
+func (m *Metrics) writePrometheus(p *promWriter) {
+	// Входящие запросы
+	p.counter("requests_total", "Входящие запросы", atomic.LoadUint64(&m.TotalRequests))
+	p.family("request_results_total", "counter", "Завершенные запросы по исходу")
+	p.sample("request_results_total", float64(atomic.LoadUint64(&m.SuccessfulRequests)), "result", "success")
+	p.sample("request_results_total", float64(atomic.LoadUint64(&m.FailedRequests)), "result", "failure")
+	p.gauge("active_connections", "Активные соединения", float64(atomic.LoadInt32(&m.ActiveConnections)))
+	p.histograms("request_duration_seconds", "Время ответа по эндпоинтам", "endpoint", &m.endpointTimes)
+	p.histograms("group_request_duration_seconds", "Время сводного ответа на рассылку по группе", "group", &m.groupTimes)
+	p.latencyWindows("request_latency_window_seconds", "Процентили и максимум времени ответа за скользящие окна",
+		"endpoint", m.endpointLatency.Summary())
+
+	// Эндпоинты
+	p.counterMap("retries_total", "Повторы запроса через другой прокси", "endpoint", &m.retries)
+	p.counterMap("hedges_total", "Хеджирующие попытки запроса", "endpoint", &m.hedges)
+	p.counterMap("hedge_wins_total", "Ответы, полученные через хеджирующую попытку", "endpoint", &m.hedgeWins)
+	p.counterMap("hedge_wasted_bytes_total", "Байты ответов отмененных попыток", "endpoint", &m.hedgeWastedBytes)
+	p.counterMap("failovers_total", "Переключения на резервный эндпоинт", "endpoint", &m.failovers)
+	p.counterMap("rate_limited_total", "Запросы, отклоненные из-за исчерпания лимита у всех прокси", "endpoint", &m.rateLimited)
+
+	names := m.Endpoints.Names()
+	sort.Strings(names)
+	p.family("endpoint_up", "gauge", "Доступность эндпоинта (1 — доступен)")
+	for _, name := range names {
+		up := 0.0
+		if m.Endpoints.health.Available(name) {
+			up = 1
+		}
+		p.sample("endpoint_up", up, "endpoint", name)
+	}
+	p.family("endpoint_latency_seconds", "gauge", "Сглаженная задержка эндпоинта")
+	for _, name := range names {
+		if latency, ok := m.Endpoints.health.Latency(name); ok {
+			p.sample("endpoint_latency_seconds", latency/1000, "endpoint", name)
+		}
+	}
+
+	// Попытки запроса к вышестоящим серверам
+	p.counterMap("upstream_transport_errors_total", "Попытки без ответа: ошибки соединения и таймауты", "endpoint", &m.transportErrors)
+	p.counterMap("upstream_errors_total", "Ответы 4xx/5xx и ошибки JSON-RPC", "endpoint", &m.upstreamErrors)
+	p.counterMap("upstream_rate_limited_total", "Ответы об ограничении частоты запросов", "endpoint", &m.upstreamLimited)
+	p.family("upstream_responses_total", "counter", "Ответы вышестоящих серверов по статусам")
+	statuses := m.upstreamStatuses.Snapshot()
+	endpoints := make([]string, 0, len(statuses))
+	for endpoint := range statuses {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		codes := statuses[endpoint]
+		for _, code := range sortedKeys(codes) {
+			p.sample("upstream_responses_total", float64(codes[code]),
+				"endpoint", endpoint, "status_class", statusClass(code), "code", code)
+		}
+	}
+
+	// Методы JSON-RPC
+	p.counterMap("jsonrpc_requests_total", "Запросы JSON-RPC по методам", "method", &m.rpcRequests)
+	p.counterMap("jsonrpc_errors_total", "Неудачные запросы JSON-RPC по методам", "method", &m.rpcErrors)
+	p.histograms("jsonrpc_request_duration_seconds", "Время ответа на запросы JSON-RPC по методам", "method", &m.rpcTimes)
+
+	m.writeProxyMetrics(p)
+
+	// Процесс
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	p.gauge("uptime_seconds", "Время работы сервера", time.Since(m.StartTime).Seconds())
+	p.gauge("memory_alloc_bytes", "Выделенная память", float64(ms.Alloc))
+	p.gauge("memory_sys_bytes", "Память, полученная от ОС", float64(ms.Sys))
+	p.gauge("goroutines", "Количество горутин", float64(runtime.NumGoroutine()))
+	p.counter("gc_cycles_total", "Циклы сборки мусора", uint64(ms.NumGC))
+}
+
+// proxyMetricLabels возвращает значения метки proxy для прокси пула. Метка
+// содержит только host:port, чтобы логины не попадали в метрики; прокси с
+// одинаковым адресом и разными логинами нумеруются в порядке списка:
+// host:port, host:port#2 и т.д.
+func proxyMetricLabels(proxies []*Proxy) []string {
+	labels := make([]string, len(proxies))
+	seen := make(map[string]int, len(proxies))
+	for i, proxy := range proxies {
+		addr := net.JoinHostPort(proxy.Host, strconv.Itoa(proxy.Port))
+		seen[addr]++
+		if n := seen[addr]; n > 1 {
+			addr += "#" + strconv.Itoa(n)
+		}
+		labels[i] = addr
+	}
+	return labels
+}
+
+// writeProxyMetrics выводит метрики пула и отдельных прокси. Прокси
+// обозначается меткой proxy (см. proxyMetricLabels).
+func (m *Metrics) writeProxyMetrics(p *promWriter) {
+	pm := m.ProxyManager
+	p.gauge("proxies", "Прокси в списке", float64(pm.GetTotalProxiesCount()))
+	p.gauge("proxies_healthy", "Работоспособные прокси", float64(pm.GetHealthyProxiesCount()))
+
+	now := time.Now()
+	proxies := pm.loadPool().proxies
+	counts := map[CircuitState]int{}
+	for _, proxy := range proxies {
+		counts[proxy.breaker.State(now)]++
+	}
+	p.family("circuit_breakers", "gauge", "Прокси по состоянию автоматического выключателя")
+	for _, state := range []CircuitState{CircuitClosed, CircuitOpen, CircuitHalfOpen} {
+		p.sample("circuit_breakers", float64(counts[state]), "state", state.String())
+	}
+	p.counter("circuit_breaker_trips_total", "Срабатывания автоматических выключателей", atomic.LoadUint64(&pm.breakerTrips))
+
+	// Ряды отдельных прокси выводятся только по metrics_proxy_series и
+	// metrics_proxy_latency_windows: на больших пулах они составляют
+	// основную часть ответа
+	if !pm.config.MetricsProxySeries && !pm.config.MetricsProxyLatencyWindows {
+		return
+	}
+	labels := proxyMetricLabels(proxies)
+
+	type proxyValue func(proxy *Proxy) float64
+	families := []struct {
+		name, kind, help string
+		value            proxyValue
+	}{
+		{"proxy_requests_total", "counter", "Запросы через прокси", func(proxy *Proxy) float64 {
+			return float64(atomic.LoadInt64(&proxy.UsageCount))
+		}},
+		{"proxy_errors_total", "counter", "Ошибки запросов через прокси", func(proxy *Proxy) float64 {
+			return float64(atomic.LoadInt64(&proxy.ErrorCount))
+		}},
+		{"proxy_retries_total", "counter", "Запросы, повторенные через другой прокси после ошибки", func(proxy *Proxy) float64 {
+			return float64(atomic.LoadInt64(&proxy.RetryCount))
+		}},
+		{"proxy_received_bytes_total", "counter", "Байты, полученные от прокси", func(proxy *Proxy) float64 {
+			return float64(atomic.LoadInt64(&proxy.stats.bytesIn))
+		}},
+		{"proxy_sent_bytes_total", "counter", "Байты, отправленные прокси", func(proxy *Proxy) float64 {
+			return float64(atomic.LoadInt64(&proxy.stats.bytesOut))
+		}},
+		{"proxy_active_tunnels", "gauge", "Открытые через прокси CONNECT-туннели", func(proxy *Proxy) float64 {
+			return float64(atomic.LoadInt64(&proxy.stats.activeTunnels))
+		}},
+		{"proxy_active_requests", "gauge", "Выполняющиеся через прокси запросы", func(proxy *Proxy) float64 {
+			return float64(atomic.LoadInt64(&proxy.ActiveConns))
+		}},
+		{"proxy_latency_seconds", "gauge", "Сглаженная задержка ответов через прокси", func(proxy *Proxy) float64 {
+			return proxy.LatencyEWMA() / 1000
+		}},
+		{"proxy_up", "gauge", "Прокси прошел активную проверку или еще не проверялся (1) либо не прошел ее (0)", func(proxy *Proxy) float64 {
+			if proxy.Health() == HealthUnhealthy {
+				return 0
+			}
+			return 1
+		}},
+		{"proxy_disabled", "gauge", "Прокси отключен через /admin/proxies", func(proxy *Proxy) float64 {
+			if proxy.Disabled() {
+				return 1
+			}
+			return 0
+		}},
+		{"proxy_circuit_open", "gauge", "Автоматический выключатель прокси разомкнут или полуоткрыт", func(proxy *Proxy) float64 {
+			if proxy.breaker.State(now) == CircuitClosed {
+				return 0
+			}
+			return 1
+		}},
+	}
+	if pm.config.MetricsProxySeries {
+		for _, f := range families {
+			p.family(f.name, f.kind, f.help)
+			for i, proxy := range proxies {
+				p.sample(f.name, f.value(proxy), "proxy", labels[i])
+			}
+		}
+	}
+
+	// Процентили за окна дают 15 рядов на прокси, поэтому выводятся
+	// только по metrics_proxy_latency_windows
+	if !pm.config.MetricsProxyLatencyWindows {
+		return
+	}
+	summaries := make(map[string]map[string]LatencySummary, len(proxies))
+	for i, proxy := range proxies {
+		if summary := proxy.latency.Summary(); len(summary) > 0 {
+			summaries[labels[i]] = summary
+		}
+	}
+	p.latencyWindows("proxy_latency_window_seconds", "Процентили и максимум задержки ответов через прокси за скользящие окна",
+		"proxy", summaries)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteProxyMetricsSeries(t *testing.T) {
+	proxies := `[
+  {"host":"10.0.0.1","port":1080,"user":"alice","pass":"secret"},
+  {"host":"10.0.0.1","port":1080,"user":"bob","pass":"secret"},
+  {"host":"::1","port":3128}
+]`
+	for _, tc := range []struct {
+		name            string
+		settings        map[string]interface{}
+		series, windows bool
+	}{
+		{"по умолчанию", nil, false, false},
+		{"ряды прокси", map[string]interface{}{"metrics_proxy_series": true}, true, false},
+		{"окна задержки", map[string]interface{}{"metrics_proxy_latency_windows": true}, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pm := newTestProxyManager(t, tc.settings, proxies)
+			pm.proxies[0].latency.Observe(10 * time.Millisecond)
+			p := &promWriter{}
+			(&Metrics{ProxyManager: pm}).writeProxyMetrics(p)
+			out := p.buf.String()
+
+			if !strings.Contains(out, metricsPrefix+"proxies 3\n") {
+				t.Fatalf("нет метрик пула:\n%s", out)
+			}
+			if got := strings.Contains(out, metricsPrefix+"proxy_requests_total{"); got != tc.series {
+				t.Fatalf("ряды прокси выведены: %v, ожидалось %v", got, tc.series)
+			}
+			if got := strings.Contains(out, metricsPrefix+"proxy_latency_window_seconds{"); got != tc.windows {
+				t.Fatalf("окна задержки выведены: %v, ожидалось %v", got, tc.windows)
+			}
+			if strings.Contains(out, "alice") || strings.Contains(out, "bob") {
+				t.Fatalf("логин прокси попал в метрики:\n%s", out)
+			}
+			if tc.series {
+				for _, label := range []string{`proxy="10.0.0.1:1080"`, `proxy="10.0.0.1:1080#2"`, `proxy="[::1]:3128"`} {
+					if !strings.Contains(out, metricsPrefix+"proxy_up{"+label+"} 1\n") {
+						t.Fatalf("нет ряда proxy_up{%s}:\n%s", label, out)
+					}
+				}
+			}
+			if tc.windows && !strings.Contains(out, `proxy_latency_window_seconds{proxy="10.0.0.1:1080",window="1m"`) {
+				t.Fatalf("окна задержки без метки host:port:\n%s", out)
+			}
+		})
+	}
+}
@@ -1,52 +1,68 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Карта эндпоинтов
-var ENDPOINTS = map[string]string{
-	"jitoNY":        "https://ny.mainnet.block-engine.jito.wtf",
-	"jitoTOKIO":     "https://tokyo.mainnet.block-engine.jito.wtf",
-	"jitoSLC":       "https://slc.mainnet.block-engine.jito.wtf",
-	"jitoAMSTERDAM": "https://amsterdam.mainnet.block-engine.jito.wtf",
-	"jitoFRANKFURT": "https://frankfurt.mainnet.block-engine.jito.wtf",
-	"jitoLONDON":    "https://london.mainnet.block-engine.jito.wtf",
-}
-
 // ProxyServer представляет HTTP-прокси сервер
 type ProxyServer struct {
 	config        *Config           // Конфигурация
 	proxyManager  *ProxyManager     // Менеджер прокси
 	metrics       *Metrics          // Метрики
-	transportPool sync.Map          // Пул транспортов для каждого прокси
+	endpoints     *EndpointRegistry // Текущая карта эндпоинтов
+	transportPool sync.Map          // Пул транспортов для каждого прокси (ключ — transportKey)
 	requestQueue  chan *requestTask // Очередь запросов для воркеров
+	accessLog     *AccessLogger     // Журнал запросов (nil, если отключен)
+	server        *http.Server      // HTTP-сервер, останавливается через Shutdown
+	tunnels       tunnelTracker     // Открытые CONNECT-туннели
 }
 
 type requestTask struct {
-	w    http.ResponseWriter
-	r    *http.Request
-	done chan bool
+	w      http.ResponseWriter
+	r      *http.Request
+	done   chan bool
+	queued time.Time // Время постановки в очередь
 }
 
-// NewProxyServer создает новый прокси сервер
-func NewProxyServer(config *Config, pm *ProxyManager, metrics *Metrics) *ProxyServer {
-	return &ProxyServer{
+// NewProxyServer создает новый прокси сервер. accessLog может быть nil.
+func NewProxyServer(config *Config, pm *ProxyManager, metrics *Metrics, endpoints *EndpointRegistry, accessLog *AccessLogger) *ProxyServer {
+	ps := &ProxyServer{
 		config:       config,
 		proxyManager: pm,
 		metrics:      metrics,
+		endpoints:    endpoints,
+		accessLog:    accessLog,
+	}
+
+	// Настраиваем HTTP-сервер с оптимизациями
+	ps.server = &http.Server{
+		Addr:         config.ListenAddr,
+		Handler:      http.HandlerFunc(ps.handleRequest),
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  60 * time.Second,
 	}
+
+	// Закрываем транспорты прокси, удаленных при перезагрузке списка
+	pm.OnProxyRemoved(ps.evictTransport)
+
+	return ps
 }
 
 // startWorkers запускает пул воркеров для обработки запросов
@@ -60,21 +76,21 @@ func (ps *ProxyServer) startWorkers() {
 
 func (ps *ProxyServer) worker(id int) {
 	for task := range ps.requestQueue {
+		if entry := accessEntryFrom(task.r.Context()); entry != nil {
+			entry.QueueWaitMs = durationMs(time.Since(task.queued))
+		}
 		ps.processRequest(task.w, task.r)
 		task.done <- true
 	}
 }
 
 // getTransport получает или создает транспорт для прокси
-func (ps *ProxyServer) getTransport(proxyURL string) *http.Transport {
-	if t, ok := ps.transportPool.Load(proxyURL); ok {
+func (ps *ProxyServer) getTransport(proxy *Proxy) *http.Transport {
+	if t, ok := ps.transportPool.Load(proxy.transportKey()); ok {
 		return t.(*http.Transport)
 	}
 
-	parsedURL, _ := url.Parse(proxyURL)
-
 	transport := &http.Transport{
-		Proxy:                 http.ProxyURL(parsedURL),
 		MaxIdleConns:          100, // Уменьшаем для меньшей группировки
 		MaxIdleConnsPerHost:   10,  // Уменьшаем
 		MaxConnsPerHost:       0,   // Без ограничений
@@ -93,11 +109,30 @@ func (ps *ProxyServer) getTransport(proxyURL string) *http.Transport {
 			DualStack: true,
 		}).DialContext,
 	}
+	configureUpstream(transport, proxy)
+
+	// Учитываем трафик всех соединений транспорта с прокси
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return proxy.countConn(conn), nil
+	}
 
-	ps.transportPool.Store(proxyURL, transport)
+	ps.transportPool.Store(proxy.transportKey(), transport)
 	return transport
 }
 
+// evictTransport закрывает и удаляет из пула транспорт прокси
+func (ps *ProxyServer) evictTransport(p *Proxy) {
+	if t, ok := ps.transportPool.Load(p.transportKey()); ok {
+		ps.transportPool.Delete(p.transportKey())
+		t.(*http.Transport).CloseIdleConnections()
+	}
+}
+
 // startTransportCleaner запускает периодическую очистку транспортов
 func (ps *ProxyServer) startTransportCleaner() {
 	ticker := time.NewTicker(2 * time.Minute)
@@ -121,22 +156,23 @@ func (ps *ProxyServer) Start() error {
 	// Запускаем периодическую очистку транспортов
 	ps.startTransportCleaner()
 
-	// Настраиваем HTTP-сервер с оптимизациями
-	server := &http.Server{
-		Addr:         ps.config.ListenAddr,
-		Handler:      http.HandlerFunc(ps.handleRequest),
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  60 * time.Second,
-	}
+	// Запускаем проверку эндпоинтов
+	ps.StartEndpointChecker()
 
 	fmt.Printf("Прокси сервер запущен на %s с %d воркерами\n", ps.config.ListenAddr, ps.config.WorkerCount)
 	fmt.Println("Доступные эндпоинты:")
-	for name, url := range ENDPOINTS {
-		fmt.Printf(" - %s -> %s\n", name, url)
+	for _, name := range ps.endpoints.Names() {
+		ep, _ := ps.endpoints.Get(name)
+		fmt.Printf(" - %s -> %s\n", name, ep.TargetURL(""))
+	}
+	fmt.Printf(" - %s -> регион с наименьшей задержкой\n", ps.config.AutoEndpoint)
+	for _, name := range ps.endpoints.GroupNames() {
+		group, _ := ps.endpoints.Group(name)
+		fmt.Printf(" - /group/%s -> %s\n", name, strings.Join(group.Endpoints, ", "))
 	}
 
-	return server.ListenAndServe()
+	// После Shutdown возвращается http.ErrServerClosed
+	return ps.server.ListenAndServe()
 }
 
 // handleRequest обрабатывает входящие HTTP запросы
@@ -152,11 +188,15 @@ func (ps *ProxyServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w, r, entry := ps.startAccessEntry(w, r)
+	defer ps.finishAccessEntry(entry)
+
 	// Отправляем в очередь для обработки воркерами
 	task := &requestTask{
-		w:    w,
-		r:    r,
-		done: make(chan bool, 1),
+		w:      w,
+		r:      r,
+		done:   make(chan bool, 1),
+		queued: time.Now(),
 	}
 
 	select {
@@ -175,46 +215,70 @@ func (ps *ProxyServer) processRequest(w http.ResponseWriter, r *http.Request) {
 	ps.metrics.IncrementActiveConnections()
 	defer ps.metrics.DecrementActiveConnections()
 
-	// Парсим путь для определения целевого URL
-	targetURL, err := ps.parseTargetURL(r.URL.Path)
+	// Для HTTPS-запросов используем туннелирование
+	if r.Method == http.MethodConnect {
+		if _, _, err := ps.parseTargetURL(r.URL.Path); err != nil {
+			ps.metrics.IncrementFailedRequests()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ps.handleTunneling(w, r)
+		return
+	}
+
+	// Рассылка по группе эндпоинтов: /all/... и /group/<name>/...
+	group, remainingPath, isFanout, err := ps.parseFanoutPath(r.URL.Path)
 	if err != nil {
 		ps.metrics.IncrementFailedRequests()
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Для HTTPS-запросов используем туннелирование
-	if r.Method == http.MethodConnect {
-		ps.handleTunneling(w, r)
-		return
+	// Парсим путь для определения эндпоинтов
+	var chain []*Endpoint
+	if !isFanout {
+		chain, remainingPath, err = ps.parseTargetURL(r.URL.Path)
+		if err != nil {
+			ps.metrics.IncrementFailedRequests()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
-	// Создаем новый URL для запроса
-	parsedURL, err := url.Parse(targetURL)
+	body, err := readRequestBody(r, ps.config.RetryMaxBody)
 	if err != nil {
 		ps.metrics.IncrementFailedRequests()
-		http.Error(w, fmt.Sprintf("Ошибка парсинга URL: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Перенаправляем запрос
-	r.URL = parsedURL
-	ps.handleHTTP(w, r)
+	// Извлекаем метод JSON-RPC и применяем маршрут для него
+	if ps.config.JSONRPCInspect {
+		body.rpc = inspectJSONRPC(r, body)
+		accessEntryFrom(r.Context()).setRPC(body.rpc)
+		if body.rpc != nil && !isFanout {
+			if target, ok := ps.config.MethodRoutes[body.rpc.Method]; ok {
+				if routed := ps.endpointChain(target); len(routed) > 0 {
+					chain = routed
+				}
+			}
+		}
+	}
+
+	if isFanout {
+		ps.handleFanout(w, r, group, remainingPath, body)
+		return
+	}
+	ps.handleHTTP(w, r, chain, remainingPath, body)
 }
 
-// parseTargetURL извлекает целевой URL из пути запроса
-func (ps *ProxyServer) parseTargetURL(path string) (string, error) {
+// parseTargetURL извлекает из пути запроса эндпоинты в порядке очередности
+// (основной и резервные) и оставшийся путь
+func (ps *ProxyServer) parseTargetURL(path string) ([]*Endpoint, string, error) {
 	trimmedPath := strings.TrimPrefix(path, "/")
 	components := strings.SplitN(trimmedPath, "/", 2)
 	if len(components) == 0 {
-		return "", fmt.Errorf("Некорректный путь запроса")
-	}
-
-	endpointKey := components[0]
-	endpoint, exists := ENDPOINTS[endpointKey]
-
-	if !exists {
-		return "", fmt.Errorf("Неизвестный эндпоинт: %s", endpointKey)
+		return nil, "", fmt.Errorf("Некорректный путь запроса")
 	}
 
 	var remainingPath string
@@ -224,44 +288,161 @@ func (ps *ProxyServer) parseTargetURL(path string) (string, error) {
 		remainingPath = "/"
 	}
 
-	return endpoint + remainingPath, nil
+	endpointKey := components[0]
+	chain := ps.endpointChain(endpointKey)
+	if chain == nil {
+		if endpointKey == ps.config.AutoEndpoint {
+			return nil, "", fmt.Errorf("Нет эндпоинтов для %s", endpointKey)
+		}
+		return nil, "", fmt.Errorf("Неизвестный эндпоинт: %s", endpointKey)
+	}
+
+	return chain, remainingPath, nil
+}
+
+// endpointChain возвращает эндпоинты для имени из пути запроса: эндпоинт с
+// резервными или регионы по задержке для auto_endpoint. Для неизвестного
+// имени возвращает nil.
+func (ps *ProxyServer) endpointChain(name string) []*Endpoint {
+	if name == ps.config.AutoEndpoint {
+		chain := ps.endpoints.AutoChain()
+		if len(chain) == 0 {
+			return nil
+		}
+		return chain
+	}
+
+	endpoint, exists := ps.endpoints.Get(name)
+	if !exists {
+		return nil
+	}
+	return ps.endpoints.FailoverChain(endpoint)
 }
 
 // handleHealthCheck обрабатывает запрос проверки работоспособности
 func (ps *ProxyServer) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"status":         "ok",
-		"active_proxies": ps.proxyManager.GetTotalProxiesCount(),
+		"active_proxies": ps.proxyManager.GetHealthyProxiesCount(),
 		"total_proxies":  ps.proxyManager.GetTotalProxiesCount(),
-		"endpoints":      make([]string, 0, len(ENDPOINTS)),
+		"endpoints":      ps.endpoints.Names(),
+		"groups":         ps.endpoints.GroupNames(),
 		"workers":        ps.config.WorkerCount,
 		"queue_size":     len(ps.requestQueue),
 	}
 
-	for name := range ENDPOINTS {
-		response["endpoints"] = append(response["endpoints"].([]string), name)
-	}
-
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"status":"%s","active_proxies":%d,"total_proxies":%d,"workers":%d,"queue_size":%d}`,
-		response["status"], response["active_proxies"], response["total_proxies"],
-		response["workers"], response["queue_size"])
+	json.NewEncoder(w).Encode(response)
 }
 
-// handleHTTP обрабатывает HTTP запросы
-func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	proxy := ps.proxyManager.GetProxyWithoutCheck()
-	if proxy == nil {
+// handleHTTP обрабатывает HTTP запросы к эндпоинтам chain. При ошибке
+// соединения или статусе из retry_status_codes запрос повторяется через
+// другой прокси, пока не исчерпаны попытки или общий бюджет времени. Если
+// эндпоинт недоступен или отвечает 5xx, запрос отправляется следующему
+// эндпоинту из chain.
+func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request, chain []*Endpoint, remainingPath string, body *requestBody) {
+	policy, hedged, err := ps.resolveHedgePolicy(r, chain[0])
+	if err != nil {
 		ps.metrics.IncrementFailedRequests()
-		http.Error(w, "Нет доступных прокси", http.StatusServiceUnavailable)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	outReq, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
-	if err != nil {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(ps.config.RetryBudget)*time.Second)
+	defer cancel()
+
+	var result upstreamResult
+	var served *Endpoint
+	for i, endpoint := range chain {
+		served = endpoint
+		req, err := endpointRequest(r, endpoint, remainingPath)
+		if err != nil {
+			ps.metrics.IncrementFailedRequests()
+			http.Error(w, fmt.Sprintf("Ошибка парсинга URL: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// Хеджирование возможно только для тела, которое можно отправить повторно
+		if hedged && body.replayable {
+			result = ps.forwardHedged(ctx, req, endpoint, body, policy)
+		} else {
+			result = ps.forwardWithRetries(ctx, req, endpoint, body)
+		}
+
+		// Неудачи из-за прокси не засчитываются эндпоинту, но переключение
+		// на резервный регион по-прежнему возможно
+		failed := isEndpointFailure(result.resp, result.err)
+		if !isLocalError(result.err) && !isCanceled(result.err) && !isProxyFailure(result.proxy, result.resp, result.err) {
+			if failed {
+				ps.endpoints.health.RecordFailure(endpoint.Name, result.failureReason())
+			} else {
+				ps.endpoints.health.RecordSuccess(endpoint.Name, result.duration)
+			}
+		}
+		if !failed || i == len(chain)-1 || !body.replayable || ctx.Err() != nil {
+			break
+		}
+
+		// Переключаемся на следующий регион
+		result.close(ps.proxyManager)
+		ps.metrics.IncrementFailovers(endpoint.Name)
+	}
+
+	accessEntryFrom(r.Context()).setUpstream(served.Name, result.proxy, result.resp, result.duration, result.err)
+	if body.rpc != nil {
+		failed := result.err != nil || responseClass(result.resp) != UpstreamOK
+		ps.metrics.RecordRPC(body.rpc.Method, result.duration, failed)
+	}
+
+	switch {
+	case result.err == errNoProxies:
 		ps.metrics.IncrementFailedRequests()
-		http.Error(w, fmt.Sprintf("Ошибка создания запроса: %v", err), http.StatusInternalServerError)
-		return
+		http.Error(w, "Нет доступных прокси", http.StatusServiceUnavailable)
+	case result.err == errRateLimited:
+		ps.metrics.IncrementFailedRequests()
+		retryAfter := ps.proxyManager.RateLimitRetryAfter(chain[len(chain)-1].Name)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "Исчерпан лимит запросов через все прокси", http.StatusTooManyRequests)
+	case result.err != nil:
+		ps.metrics.IncrementFailedRequests()
+		http.Error(w, fmt.Sprintf("Ошибка запроса: %v", result.err), http.StatusBadGateway)
+	default:
+		// Ответ передается клиенту как есть, но 4xx/5xx и ошибки JSON-RPC
+		// не считаются успешными запросами
+		if responseClass(result.resp) == UpstreamOK {
+			ps.metrics.IncrementSuccessfulRequests()
+		} else {
+			ps.metrics.IncrementFailedRequests()
+		}
+		ps.metrics.RecordResponseTime(served.Name, result.duration)
+		writeUpstreamResponse(w, result.resp)
+		result.close(ps.proxyManager)
+	}
+}
+
+// endpointRequest возвращает копию запроса, направленную на эндпоинт,
+// с сохранением параметров строки запроса
+func endpointRequest(r *http.Request, endpoint *Endpoint, remainingPath string) (*http.Request, error) {
+	targetURL, err := url.Parse(endpoint.TargetURL(remainingPath))
+	if err != nil {
+		return nil, err
+	}
+	targetURL.RawQuery = r.URL.RawQuery
+
+	req := r.WithContext(r.Context())
+	req.URL = targetURL
+	return req, nil
+}
+
+// doUpstream отправляет одну попытку запроса к эндпоинту через прокси
+func (ps *ProxyServer) doUpstream(ctx context.Context, proxy *Proxy, r *http.Request, endpoint *Endpoint, body *requestBody) (*http.Response, time.Duration, error) {
+	ctx, reached := traceEndpointConn(ctx)
+	outReq, err := http.NewRequestWithContext(ctx, r.Method, r.URL.String(), body.reader())
+	if err != nil {
+		return nil, 0, fmt.Errorf("ошибка создания запроса: %v", err)
+	}
+	if !body.replayable {
+		outReq.ContentLength = body.length
 	}
 
 	// Копируем заголовки
@@ -271,8 +452,15 @@ func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Добавляем заголовки эндпоинта, если клиент их не передал
+	for name, value := range endpoint.Headers {
+		if outReq.Header.Get(name) == "" {
+			outReq.Header.Set(name, value)
+		}
+	}
+
 	// Получаем транспорт из пула
-	transport := ps.getTransport(proxy.URL)
+	transport := ps.getTransport(proxy)
 
 	client := &http.Client{
 		Transport: transport,
@@ -284,19 +472,30 @@ func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 
 	startTime := time.Now()
 	resp, err := client.Do(outReq)
-	requestDuration := time.Since(startTime)
+	duration := time.Since(startTime)
+	if err != nil && !reached() {
+		err = &proxySideError{err: err}
+	}
 
+	// Учитываем исход попытки: ошибки транспорта отдельно от ответов
+	// вышестоящего сервера. Отмененные попытки не учитываются.
 	if err != nil {
-		ps.metrics.IncrementFailedRequests()
-		ps.proxyManager.IncrementProxyErrorCount(proxy.URL)
-		http.Error(w, fmt.Sprintf("Ошибка запроса: %v", err), http.StatusBadGateway)
-		return
+		if ctx.Err() == nil {
+			ps.metrics.IncrementTransportErrors(endpoint.Name)
+		}
+		return nil, duration, err
 	}
-	defer resp.Body.Close()
 
-	ps.metrics.IncrementSuccessfulRequests()
-	ps.metrics.RecordResponseTime(requestDuration)
+	class := ps.classifyResponse(resp)
+	ps.metrics.RecordUpstreamResponse(endpoint.Name, resp.StatusCode, class)
+	if class == UpstreamRateLimited {
+		ps.proxyManager.CooldownProxy(proxy, endpoint.Name, ps.retryAfter(resp))
+	}
+	return resp, duration, nil
+}
 
+// writeUpstreamResponse копирует ответ вышестоящего сервера клиенту
+func writeUpstreamResponse(w http.ResponseWriter, resp *http.Response) {
 	// Копируем заголовки ответа
 	for name, values := range resp.Header {
 		for _, value := range values {
@@ -307,7 +506,7 @@ func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Используем большой буфер для копирования
 	buf := make([]byte, 256*1024) // 256KB буфер
-	_, err = io.CopyBuffer(w, resp.Body, buf)
+	_, err := io.CopyBuffer(w, resp.Body, buf)
 	if err != nil && err != io.EOF {
 		log.Printf("Error copying response body: %v", err)
 	}
@@ -315,65 +514,31 @@ func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 
 // handleTunneling обрабатывает HTTPS запросы через туннелирование
 func (ps *ProxyServer) handleTunneling(w http.ResponseWriter, r *http.Request) {
+	defer ps.tunnels.begin()()
+
 	proxy := ps.proxyManager.GetProxyWithoutCheck()
 	if proxy == nil {
 		ps.metrics.IncrementFailedRequests()
 		http.Error(w, "Нет доступных прокси", http.StatusServiceUnavailable)
 		return
 	}
+	defer ps.proxyManager.ReleaseProxy(proxy)
 
-	proxyURL, err := url.Parse(proxy.URL)
-	if err != nil {
-		ps.metrics.IncrementFailedRequests()
-		http.Error(w, fmt.Sprintf("Ошибка разбора URL прокси: %v", err), http.StatusInternalServerError)
-		return
+	startTime := time.Now()
+	entry := accessEntryFrom(r.Context())
+	if entry != nil {
+		entry.Proxy = proxy.MaskedURL()
 	}
-
-	proxyConn, err := net.DialTimeout("tcp", proxyURL.Host, time.Duration(ps.config.Timeout)*time.Second)
+	proxyConn, err := dialViaProxy(proxy, r.Host, time.Duration(ps.config.Timeout)*time.Second)
 	if err != nil {
 		ps.metrics.IncrementFailedRequests()
-		ps.proxyManager.IncrementProxyErrorCount(proxy.URL)
-		http.Error(w, fmt.Sprintf("Ошибка соединения с прокси: %v", err), http.StatusBadGateway)
+		ps.proxyManager.IncrementProxyErrorCount(proxy.URL, err.Error())
+		http.Error(w, fmt.Sprintf("Ошибка установки туннеля через прокси: %v", err), http.StatusBadGateway)
 		return
 	}
+	proxyConn = proxy.countConn(proxyConn)
 	defer proxyConn.Close()
-
-	// Устанавливаем размеры буферов для TCP соединения
-	if tcpConn, ok := proxyConn.(*net.TCPConn); ok {
-		tcpConn.SetReadBuffer(256 * 1024)  // 256KB
-		tcpConn.SetWriteBuffer(256 * 1024) // 256KB
-	}
-
-	auth := ""
-	if proxyURL.User != nil {
-		username := proxyURL.User.Username()
-		password, _ := proxyURL.User.Password()
-		auth = fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", basicAuth(username, password))
-	}
-
-	connectReq := fmt.Sprintf(
-		"CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n",
-		r.Host, r.Host, auth,
-	)
-	fmt.Fprint(proxyConn, connectReq)
-
-	buffer := make([]byte, 1024)
-	proxyConn.SetReadDeadline(time.Now().Add(time.Duration(ps.config.Timeout) * time.Second))
-	n, err := proxyConn.Read(buffer)
-	if err != nil {
-		ps.metrics.IncrementFailedRequests()
-		ps.proxyManager.IncrementProxyErrorCount(proxy.URL)
-		http.Error(w, fmt.Sprintf("Ошибка чтения ответа от прокси: %v", err), http.StatusBadGateway)
-		return
-	}
-
-	response := string(buffer[:n])
-	if !strings.Contains(response, "200") {
-		ps.metrics.IncrementFailedRequests()
-		ps.proxyManager.IncrementProxyErrorCount(proxy.URL)
-		http.Error(w, "Ошибка установки туннеля через прокси", http.StatusBadGateway)
-		return
-	}
+	ps.proxyManager.RecordProxySuccess(proxy.URL, time.Since(startTime))
 
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
@@ -389,9 +554,13 @@ func (ps *ProxyServer) handleTunneling(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	defer ps.tunnels.track(clientConn, proxyConn)()
+
 	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 
 	ps.metrics.IncrementSuccessfulRequests()
+	atomic.AddInt64(&proxy.stats.activeTunnels, 1)
+	defer atomic.AddInt64(&proxy.stats.activeTunnels, -1)
 
 	// Используем буферизованное копирование с большими буферами
 	buf1 := make([]byte, 256*1024)
@@ -403,13 +572,15 @@ func (ps *ProxyServer) handleTunneling(w http.ResponseWriter, r *http.Request) {
 	go func() {
 		defer wg.Done()
 		defer clientConn.Close()
-		io.CopyBuffer(clientConn, proxyConn, buf1)
+		n, _ := io.CopyBuffer(clientConn, proxyConn, buf1)
+		entry.addTunnelBytes(0, n)
 	}()
 
 	go func() {
 		defer wg.Done()
 		defer proxyConn.Close()
-		io.CopyBuffer(proxyConn, clientConn, buf2)
+		n, _ := io.CopyBuffer(proxyConn, clientConn, buf2)
+		entry.addTunnelBytes(n, 0)
 	}()
 
 	wg.Wait()
@@ -1,104 +1,457 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"math/rand"
-	"os"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // ProxyJSON представляет структуру прокси в JSON-файле
 type ProxyJSON struct {
-	Host string `json:"host"`
-	Port int    `json:"port"`
-	User string `json:"user"`
-	Pass string `json:"pass"`
+	Host   string   `json:"host"`
+	Port   int      `json:"port"`
+	User   string   `json:"user"`
+	Pass   string   `json:"pass"`
+	Weight *float64 `json:"weight,omitempty"` // Вес для взвешенной ротации (по умолчанию 1)
+	Scheme string   `json:"scheme,omitempty"` // Схема подключения: http (по умолчанию), https, socks5, socks5h
+
+	Tags     []string `json:"tags,omitempty"`     // Произвольные метки для отбора прокси
+	Disabled bool     `json:"disabled,omitempty"` // Прокси отключен и не выдается
+
+	// Настройки TLS для https-прокси
+	TLSServerName string `json:"tls_server_name,omitempty"` // SNI, по умолчанию — host
+	CAFile        string `json:"ca_file,omitempty"`         // CA-бандл для проверки сертификата прокси
+	CertFile      string `json:"cert_file,omitempty"`       // Клиентский сертификат
+	KeyFile       string `json:"key_file,omitempty"`        // Ключ клиентского сертификата
 }
 
 // Proxy представляет информацию о прокси
 type Proxy struct {
-	URL        string    // Полный URL прокси (формируется из host, port, user, pass)
-	Host       string    // Хост прокси
-	Port       int       // Порт прокси
-	User       string    // Имя пользователя для аутентификации (может быть пустым)
-	Pass       string    // Пароль для аутентификации (может быть пустым)
-	Weight     float64   // Вес для взвешенной ротации
-	ErrorCount int       // Счетчик ошибок
-	LastUsed   time.Time // Время последнего использования
-	UsageCount int       // Счетчик использований
+	// Счетчики изменяются атомарно, без блокировки менеджера.
+	// 64-битные поля идут первыми для выравнивания на 32-битных платформах.
+	ErrorCount  int64  // Счетчик ошибок
+	UsageCount  int64  // Счетчик использований
+	ActiveConns int64  // Количество выполняющихся через прокси запросов
+	RetryCount  int64  // Запросы, повторенные через другой прокси после ошибки этого
+	lastUsed    int64  // Время последнего использования (UnixNano)
+	latencyBits uint64 // EWMA задержки в миллисекундах (биты float64)
+	health      int32  // Состояние по результатам активной проверки (HealthState)
+	disabled    int32  // Прокси отключен администратором (1) и не выдается
+
+	URL    string   // Полный URL прокси (формируется из scheme, host, port, user, pass)
+	Scheme string   // Схема подключения к прокси
+	Host   string   // Хост прокси
+	Port   int      // Порт прокси
+	User   string   // Имя пользователя для аутентификации (может быть пустым)
+	Pass   string   // Пароль для аутентификации (может быть пустым)
+	Weight float64  // Вес для взвешенной ротации
+	Tags   []string // Метки прокси
+
+	TLSServerName string // SNI для https-прокси
+	CAFile        string // CA-бандл для https-прокси
+	CertFile      string // Клиентский сертификат для https-прокси
+	KeyFile       string // Ключ клиентского сертификата
+
+	LastCheck     time.Time     // Время последней проверки
+	CheckLatency  time.Duration // Время контрольного запроса при последней успешной проверке
+	CheckFailures int           // Подряд неудачных проверок
+	LastCheckErr  string        // Ошибка последней неудачной проверки
+
+	parsedURL *url.URL         // Разобранный URL прокси
+	tlsConfig *tls.Config      // Настройки TLS для https-прокси
+	breaker   *CircuitBreaker  // Автомат защиты от сбойных прокси
+	latency   *latencyRecorder // Процентили задержки за скользящие окна
+	stats     *proxyStats      // Трафик, успешные запросы и последняя ошибка
+}
+
+// LastUsed возвращает время последнего использования прокси
+func (p *Proxy) LastUsed() time.Time {
+	nanos := atomic.LoadInt64(&p.lastUsed)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// markUsed обновляет статистику использования прокси
+func (p *Proxy) markUsed(now time.Time) {
+	atomic.StoreInt64(&p.lastUsed, now.UnixNano())
+	atomic.AddInt64(&p.UsageCount, 1)
+	atomic.AddInt64(&p.ActiveConns, 1)
+}
+
+// LatencyEWMA возвращает сглаженную задержку прокси в миллисекундах
+func (p *Proxy) LatencyEWMA() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&p.latencyBits))
+}
+
+// observeLatency добавляет замер задержки в экспоненциальное среднее
+func (p *Proxy) observeLatency(d time.Duration) {
+	sample := float64(d) / float64(time.Millisecond)
+	for {
+		oldBits := atomic.LoadUint64(&p.latencyBits)
+		old := math.Float64frombits(oldBits)
+		value := sample
+		if old > 0 {
+			value = old + latencyEWMAAlpha*(sample-old)
+		}
+		if atomic.CompareAndSwapUint64(&p.latencyBits, oldBits, math.Float64bits(value)) {
+			return
+		}
+	}
+}
+
+// Health возвращает состояние прокси по результатам активной проверки
+func (p *Proxy) Health() HealthState {
+	return HealthState(atomic.LoadInt32(&p.health))
+}
+
+// setHealth устанавливает состояние прокси
+func (p *Proxy) setHealth(h HealthState) {
+	atomic.StoreInt32(&p.health, int32(h))
+}
+
+// Disabled сообщает, отключен ли прокси администратором
+func (p *Proxy) Disabled() bool {
+	return atomic.LoadInt32(&p.disabled) == 1
+}
+
+// setDisabled отключает или включает прокси
+func (p *Proxy) setDisabled(disabled bool) {
+	var value int32
+	if disabled {
+		value = 1
+	}
+	atomic.StoreInt32(&p.disabled, value)
+}
+
+// HealthState описывает состояние прокси по результатам активной проверки
+type HealthState int32
+
+const (
+	HealthUnknown   HealthState = iota // Прокси еще не проверялся
+	HealthHealthy                      // Последние проверки прошли успешно
+	HealthUnhealthy                    // Прокси не прошел проверку
+)
+
+// String возвращает текстовое представление состояния
+func (h HealthState) String() string {
+	switch h {
+	case HealthHealthy:
+		return "healthy"
+	case HealthUnhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// latencyEWMAAlpha — вес нового замера в сглаженной задержке прокси
+const latencyEWMAAlpha = 0.3
+
+// maxSampleAttempts ограничивает число выборок из таблицы весов, после
+// которых выбор переходит к полному перебору подходящих прокси
+const maxSampleAttempts = 16
+
+// proxyPool — неизменяемый снимок списка прокси, по которому выбор
+// выполняется без блокировок
+type proxyPool struct {
+	proxies []*Proxy
+	weights []float64 // Веса на момент построения снимка
+	alias   *aliasTable
+}
+
+// newProxyPool строит снимок с таблицей весов
+func newProxyPool(proxies []*Proxy) *proxyPool {
+	weights := make([]float64, len(proxies))
+	for i, p := range proxies {
+		weights[i] = p.Weight
+	}
+	return &proxyPool{
+		proxies: proxies,
+		weights: weights,
+		alias:   newAliasTable(weights),
+	}
 }
 
 // ProxyManager управляет списком прокси
 type ProxyManager struct {
-	proxies []*Proxy     // Список прокси
-	mu      sync.RWMutex // Мьютекс для синхронизации
-	config  *Config      // Конфигурация
+	breakerTrips uint64 // Сколько раз срабатывали автоматы защиты
+
+	proxies []*Proxy          // Список прокси
+	byURL   map[string]*Proxy // Индекс прокси по URL
+	pool    atomic.Value      // Текущий снимок для выбора (*proxyPool)
+	mu      sync.RWMutex      // Мьютекс для синхронизации
+	config  *Config           // Конфигурация
+
+	// reloadMu упорядочивает изменения списка из файла и через /admin/proxies:
+	// удерживается от чтения файла до применения, чтобы перезагрузка
+	// по SIGHUP и по таймеру не применила устаревшее содержимое поверх новой
+	reloadMu sync.Mutex
+
+	selector          Selector            // Стратегия выбора по умолчанию
+	endpointSelectors map[string]Selector // Стратегии для отдельных эндпоинтов
+
+	limiter *rateLimiter // Лимиты запросов для пар (прокси, эндпоинт)
+
+	persistFormat string // Формат записи proxies_file при admin_persist
+
+	removedHandlers []func(p *Proxy) // Обработчики удаления прокси из списка
 }
 
 // NewProxyManager создает новый менеджер прокси
 func NewProxyManager(config *Config) (*ProxyManager, error) {
 	// Читаем список прокси из файла
-	proxies, err := loadProxiesFromFile(config.ProxiesFile)
+	proxies, err := loadProxiesFromFile(config)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка при загрузке прокси: %v", err)
 	}
 
+	// Формат записи проверяется при запуске, а не при первом изменении через /admin/proxies
+	var persistFormat string
+	if config.AdminPersist {
+		if persistFormat, err = proxiesPersistFormat(config); err != nil {
+			return nil, err
+		}
+	}
+
+	selector, err := newSelector(config.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	endpointSelectors := make(map[string]Selector, len(config.EndpointSelectors))
+	for endpoint, name := range config.EndpointSelectors {
+		s, err := newSelector(name)
+		if err != nil {
+			return nil, fmt.Errorf("эндпоинт %s: %v", endpoint, err)
+		}
+		endpointSelectors[endpoint] = s
+	}
+
 	pm := &ProxyManager{
-		proxies: proxies,
-		config:  config,
+		proxies:           proxies,
+		byURL:             make(map[string]*Proxy, len(proxies)),
+		config:            config,
+		selector:          selector,
+		endpointSelectors: endpointSelectors,
+		limiter:           newRateLimiter(config),
+		persistFormat:     persistFormat,
+	}
+	pm.removedHandlers = append(pm.removedHandlers, pm.forgetRateLimits)
+	for _, p := range proxies {
+		p.breaker = newCircuitBreaker(config)
+		p.latency = newLatencyRecorder()
+		p.stats = newProxyStats()
+		pm.byURL[p.URL] = p
+	}
+	pm.rebuildPool()
+
+	// Статистика прошлого запуска; без нее сбойные прокси снова получают полный трафик
+	if err := pm.restoreState(); err != nil {
+		log.Printf("Ошибка восстановления состояния прокси: %v", err)
 	}
 
 	return pm, nil
 }
 
-// GetProxyWithoutCheck возвращает прокси без проверки его активности
+// rebuildPool публикует новый снимок списка прокси.
+// Вызывается при изменении списка или весов под pm.mu.
+func (pm *ProxyManager) rebuildPool() {
+	proxies := make([]*Proxy, len(pm.proxies))
+	copy(proxies, pm.proxies)
+	pm.pool.Store(newProxyPool(proxies))
+}
+
+// loadPool возвращает текущий снимок списка прокси
+func (pm *ProxyManager) loadPool() *proxyPool {
+	return pm.pool.Load().(*proxyPool)
+}
+
+// GetProxyWithoutCheck возвращает прокси без проверки его активности.
+// Прокси, не прошедшие фоновую проверку или находящиеся на карантине, пропускаются.
 func (pm *ProxyManager) GetProxyWithoutCheck() *Proxy {
-	pm.mu.RLock()
-	defer pm.mu.RUnlock()
+	return pm.GetProxyForEndpoint("", nil)
+}
 
-	if len(pm.proxies) == 0 {
+// GetProxyForEndpoint возвращает прокси для запроса к эндпоинту, используя
+// заданную для него стратегию выбора или стратегию по умолчанию. Это путь
+// выбора с учетом фоновой проверки: прокси, помеченные нерабочими, не
+// выдаются, а еще не проверенные выдаются, чтобы сервер работал до первой
+// проверки и при отключенной проверке.
+// Прокси из exclude (например, уже опробованные для запроса) не выдаются.
+func (pm *ProxyManager) GetProxyForEndpoint(endpoint string, exclude map[*Proxy]bool) *Proxy {
+	return pm.selectProxy(pm.selectorFor(endpoint), endpoint, func(p *Proxy) bool {
+		return !exclude[p] && p.Health() != HealthUnhealthy
+	})
+}
+
+// GetProbeProxy возвращает прокси для контрольного запроса к эндпоинту.
+// В отличие от GetProxyForEndpoint не забирает токен лимита и не занимает
+// пробный запрос полуоткрытого автомата: выдаются только прокси с замкнутым
+// автоматом. После использования прокси нужно вернуть через ReleaseProxy.
+func (pm *ProxyManager) GetProbeProxy(endpoint string) *Proxy {
+	pool := pm.loadPool()
+	if len(pool.proxies) == 0 {
 		return nil
 	}
 
-	// Используем взвешенную ротацию по алгоритму Round Robin
-	// с учетом времени последнего использования
 	now := time.Now()
-	var selectedProxy *Proxy
+	i := pm.selectorFor(endpoint).Select(pool, func(i int) bool {
+		p := pool.proxies[i]
+		return !p.Disabled() && p.Health() != HealthUnhealthy &&
+			p.breaker.State(now) == CircuitClosed && pm.limiter.cooldownLeft(p, endpoint, now) <= 0
+	})
+	if i < 0 {
+		return nil
+	}
 
-	// Пробуем найти прокси, который не использовался дольше всего
-	oldestUsedTime := now
-	for _, p := range pm.proxies {
-		if p.LastUsed.IsZero() || p.LastUsed.Before(oldestUsedTime) {
-			oldestUsedTime = p.LastUsed
-			selectedProxy = p
+	p := pool.proxies[i]
+	atomic.AddInt64(&p.ActiveConns, 1)
+	return p
+}
+
+// selectorFor возвращает стратегию выбора для эндпоинта
+func (pm *ProxyManager) selectorFor(endpoint string) Selector {
+	if s, ok := pm.endpointSelectors[endpoint]; ok {
+		return s
+	}
+	return pm.selector
+}
+
+// selectProxy выбирает прокси стратегией selector среди удовлетворяющих
+// условию allowed, не охлаждаемых и имеющих токен для эндпоинта endpoint, забирает
+// токен и резервирует запрос в автомате защиты прокси.
+// После использования прокси нужно вернуть через ReleaseProxy.
+func (pm *ProxyManager) selectProxy(selector Selector, endpoint string, allowed func(p *Proxy) bool) *Proxy {
+	pool := pm.loadPool()
+	if len(pool.proxies) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var rejected map[int]bool
+	eligible := func(i int) bool {
+		p := pool.proxies[i]
+		if rejected[i] || p.Disabled() || !allowed(p) || !p.breaker.Ready(now) || pm.limiter.cooldownLeft(p, endpoint, now) > 0 {
+			return false
 		}
+		b := pm.limiter.bucket(p, endpoint, now)
+		return b == nil || b.ready(now)
 	}
 
-	// Если все прокси использовались недавно, просто берем следующий по очереди
-	if selectedProxy == nil {
-		selectedProxy = pm.proxies[rand.Intn(len(pm.proxies))]
+	// Несколько попыток на случай, если пробный запрос к полуоткрытому
+	// прокси или последний токен успел забрать другой поток
+	for attempt := 0; attempt < 3; attempt++ {
+		i := selector.Select(pool, eligible)
+		if i < 0 {
+			return nil
+		}
+
+		p := pool.proxies[i]
+		b := pm.limiter.bucket(p, endpoint, now)
+		if b == nil || b.take(now) {
+			if p.breaker.Acquire(now) {
+				p.markUsed(now)
+				return p
+			}
+			if b != nil {
+				b.refund()
+			}
+		}
+
+		if rejected == nil {
+			rejected = make(map[int]bool)
+		}
+		rejected[i] = true
 	}
 
-	// Обновляем статистику прокси
-	selectedProxy.LastUsed = now
-	selectedProxy.UsageCount++
+	return nil
+}
 
-	return selectedProxy
+// ReleaseProxy отмечает завершение запроса через прокси
+func (pm *ProxyManager) ReleaseProxy(p *Proxy) {
+	atomic.AddInt64(&p.ActiveConns, -1)
 }
 
-// IncrementProxyErrorCount увеличивает счетчик ошибок прокси
-func (pm *ProxyManager) IncrementProxyErrorCount(proxyURL string) {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
+// IncrementProxyRetryCount учитывает повтор запроса после ошибки прокси
+func (pm *ProxyManager) IncrementProxyRetryCount(p *Proxy) {
+	atomic.AddInt64(&p.RetryCount, 1)
+}
+
+// AbandonProxyAttempt учитывает попытку через прокси, прерванную без
+// результата: она не засчитывается прокси, но освобождает пробный запрос
+// автомата защиты
+func (pm *ProxyManager) AbandonProxyAttempt(p *Proxy) {
+	p.breaker.AbandonTrial()
+}
 
+// IncrementProxyErrorCount увеличивает счетчик ошибок прокси, запоминает
+// причину и сообщает об ошибке автомату защиты
+func (pm *ProxyManager) IncrementProxyErrorCount(proxyURL, reason string) {
+	pm.mu.RLock()
+	p, ok := pm.byURL[proxyURL]
+	pm.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	atomic.AddInt64(&p.ErrorCount, 1)
+	p.stats.recordError(reason)
+	if p.breaker.RecordFailure(time.Now()) {
+		atomic.AddUint64(&pm.breakerTrips, 1)
+		log.Printf("Прокси %s:%d отправлен на карантин", p.Host, p.Port)
+	}
+}
+
+// RecordProxySuccess сообщает автомату защиты об успешном запросе через прокси
+// и учитывает задержку запроса
+func (pm *ProxyManager) RecordProxySuccess(proxyURL string, latency time.Duration) {
+	pm.mu.RLock()
+	p, ok := pm.byURL[proxyURL]
+	pm.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	atomic.AddInt64(&p.stats.successCount, 1)
+	p.observeLatency(latency)
+	p.latency.Observe(latency)
+	if p.breaker.RecordSuccess(time.Now()) {
+		log.Printf("Прокси %s:%d возвращен в ротацию после карантина", p.Host, p.Port)
+	}
+}
+
+// GetCircuitStats возвращает количество прокси в каждом состоянии автомата
+// защиты и общее число его срабатываний
+func (pm *ProxyManager) GetCircuitStats() map[string]interface{} {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	now := time.Now()
+	counts := map[string]int{
+		CircuitClosed.String():   0,
+		CircuitOpen.String():     0,
+		CircuitHalfOpen.String(): 0,
+	}
 	for _, p := range pm.proxies {
-		if p.URL == proxyURL {
-			p.ErrorCount++
-			break
-		}
+		counts[p.breaker.State(now).String()]++
+	}
+
+	return map[string]interface{}{
+		"closed":    counts[CircuitClosed.String()],
+		"open":      counts[CircuitOpen.String()],
+		"half_open": counts[CircuitHalfOpen.String()],
+		"trips":     atomic.LoadUint64(&pm.breakerTrips),
 	}
 }
 
@@ -110,68 +463,153 @@ func (pm *ProxyManager) GetTotalProxiesCount() int {
 	return len(pm.proxies)
 }
 
-// GetProxiesStats возвращает статистику по всем прокси
-func (pm *ProxyManager) GetProxiesStats() []map[string]interface{} {
+// GetHealthyProxiesCount возвращает количество прокси, не помеченных как нерабочие
+func (pm *ProxyManager) GetHealthyProxiesCount() int {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
-	stats := make([]map[string]interface{}, 0, len(pm.proxies))
+	count := 0
 	for _, p := range pm.proxies {
-		stats = append(stats, map[string]interface{}{
-			"host":        p.Host,
-			"port":        p.Port,
-			"usage_count": p.UsageCount,
-			"error_count": p.ErrorCount,
-			"last_used":   p.LastUsed,
-		})
+		if p.Health() != HealthUnhealthy {
+			count++
+		}
+	}
+	return count
+}
+
+// GetProxiesStats возвращает статистику по прокси, упорядоченную
+// и ограниченную параметрами query
+func (pm *ProxyManager) GetProxiesStats(query proxyStatsQuery) []map[string]interface{} {
+	pm.mu.RLock()
+	proxies := append([]*Proxy(nil), pm.proxies...)
+	pm.mu.RUnlock()
+
+	proxies = query.apply(proxies)
+
+	// Вес, метки и результаты проверок изменяются под pm.mu
+	now := time.Now()
+	stats := make([]map[string]interface{}, 0, len(proxies))
+	pm.mu.RLock()
+	for _, p := range proxies {
+		stats = append(stats, proxyStatsEntry(p, now))
 	}
+	pm.mu.RUnlock()
 
 	return stats
 }
 
-// loadProxiesFromFile загружает список прокси из JSON-файла
-func loadProxiesFromFile(filename string) ([]*Proxy, error) {
-	file, err := os.Open(filename)
+// loadProxiesFromFile загружает список прокси из файла proxies_file в формате
+// proxies_format. Повторяющиеся записи (host:port:user) пропускаются с предупреждением.
+func loadProxiesFromFile(config *Config) ([]*Proxy, error) {
+	filename, format := config.ProxiesFile, config.ProxiesFormat
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	// Читаем JSON-файл
-	var proxyJSONList []ProxyJSON
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&proxyJSONList); err != nil {
-		return nil, fmt.Errorf("ошибка парсинга JSON: %v", err)
+	if format == "" || format == ProxiesFormatAuto {
+		format = detectProxiesFormat(filename, data)
 	}
 
-	// Конвертируем JSON-данные в структуру Proxy
+	entries, err := parseProxyList(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	// Конвертируем записи файла в структуру Proxy
+	tlsLoader := newProxyTLSLoader(config.ProxyCAFile)
 	var proxies []*Proxy
-	for _, pjson := range proxyJSONList {
-		// Формируем URL прокси из компонентов
-		proxyURL := ""
-
-		if pjson.User != "" && pjson.Pass != "" {
-			// Если указаны логин и пароль, добавляем их в URL
-			proxyURL = fmt.Sprintf("http://%s:%s@%s:%d", pjson.User, pjson.Pass, pjson.Host, pjson.Port)
-		} else {
-			// Если логин и пароль не указаны
-			proxyURL = fmt.Sprintf("http://%s:%d", pjson.Host, pjson.Port)
+	seen := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		proxy, err := newProxyFromJSON(entry.ProxyJSON, tlsLoader)
+		if err != nil {
+			return nil, fmt.Errorf("строка %d: %v", entry.line, err)
 		}
 
-		proxies = append(proxies, &Proxy{
-			URL:    proxyURL,
-			Host:   pjson.Host,
-			Port:   pjson.Port,
-			User:   pjson.User,
-			Pass:   pjson.Pass,
-			Weight: 1.0,
-		})
+		if firstLine, dup := seen[proxy.Key()]; dup {
+			log.Printf("Строка %d: прокси %s:%d уже указан в строке %d, пропускаем", entry.line, proxy.Host, proxy.Port, firstLine)
+			continue
+		}
+		seen[proxy.Key()] = entry.line
+
+		proxies = append(proxies, proxy)
 	}
 
 	if len(proxies) == 0 {
 		return nil, fmt.Errorf("в файле не найдено прокси")
 	}
 
-	log.Printf("Загружено %d прокси из файла %s", len(proxies), filename)
+	log.Printf("Загружено %d прокси из файла %s (формат %s)", len(proxies), filename, format)
 	return proxies, nil
 }
+
+// newProxyFromJSON проверяет запись списка прокси и создает по ней Proxy
+func newProxyFromJSON(pjson ProxyJSON, tlsLoader *proxyTLSLoader) (*Proxy, error) {
+	if pjson.Host == "" {
+		return nil, fmt.Errorf("не указан хост прокси")
+	}
+	if pjson.Port <= 0 || pjson.Port > 65535 {
+		return nil, fmt.Errorf("некорректный порт %d", pjson.Port)
+	}
+
+	scheme := strings.ToLower(pjson.Scheme)
+	switch scheme {
+	case "":
+		scheme = SchemeHTTP
+	case SchemeHTTP, SchemeHTTPS, SchemeSOCKS5, SchemeSOCKS5H:
+	default:
+		return nil, fmt.Errorf("схема прокси %q не поддерживается", pjson.Scheme)
+	}
+
+	// Формируем URL прокси из компонентов
+	proxyURL := ""
+
+	if pjson.User != "" {
+		// Если указан логин, добавляем его в URL вместе с паролем. Пароль
+		// может быть пустым: авторизация все равно выполняется.
+		proxyURL = fmt.Sprintf("%s://%s@%s", scheme, url.UserPassword(pjson.User, pjson.Pass).String(),
+			net.JoinHostPort(pjson.Host, strconv.Itoa(pjson.Port)))
+	} else {
+		// Если логин не указан
+		proxyURL = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(pjson.Host, strconv.Itoa(pjson.Port)))
+	}
+
+	// Вес по умолчанию — 1; нулевой и отрицательный вес не допускаются,
+	// для исключения прокси из ротации используется disabled
+	weight := 1.0
+	if pjson.Weight != nil {
+		if weight = *pjson.Weight; weight <= 0 {
+			return nil, fmt.Errorf("вес прокси %s:%d должен быть положительным, для исключения прокси используйте disabled", pjson.Host, pjson.Port)
+		}
+	}
+
+	parsedURL, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("некорректный URL прокси: %v", err)
+	}
+
+	proxy := &Proxy{
+		URL:           proxyURL,
+		Scheme:        scheme,
+		Host:          pjson.Host,
+		Port:          pjson.Port,
+		User:          pjson.User,
+		Pass:          pjson.Pass,
+		Weight:        weight,
+		Tags:          pjson.Tags,
+		TLSServerName: pjson.TLSServerName,
+		CAFile:        pjson.CAFile,
+		CertFile:      pjson.CertFile,
+		KeyFile:       pjson.KeyFile,
+		parsedURL:     parsedURL,
+	}
+	proxy.setDisabled(pjson.Disabled)
+
+	if scheme == SchemeHTTPS {
+		if proxy.tlsConfig, err = tlsLoader.build(proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	return proxy, nil
+}
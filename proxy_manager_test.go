@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// newTestConfig записывает файл прокси proxies и конфигурацию settings во
+// временный каталог и загружает конфигурацию со значениями по умолчанию
+func newTestConfig(t *testing.T, settings map[string]interface{}, proxies string) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	proxiesFile := filepath.Join(dir, "proxies.json")
+	if err := ioutil.WriteFile(proxiesFile, []byte(proxies), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	all := map[string]interface{}{"proxies_file": proxiesFile, "check_interval": -1}
+	for key, value := range settings {
+		all[key] = value
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// newTestProxyManager создает менеджер прокси по настройкам и списку прокси
+func newTestProxyManager(t *testing.T, settings map[string]interface{}, proxies string) *ProxyManager {
+	t.Helper()
+	pm, err := NewProxyManager(newTestConfig(t, settings, proxies))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pm
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Key возвращает идентификатор прокси, по которому сопоставляются
+// записи при перезагрузке списка
+func (p *Proxy) Key() string {
+	return fmt.Sprintf("%s:%d:%s", p.Host, p.Port, p.User)
+}
+
+// tlsSettings возвращает настройки TLS прокси одной строкой для сравнения
+func (p *Proxy) tlsSettings() string {
+	return p.TLSServerName + "|" + p.CAFile + "|" + p.CertFile + "|" + p.KeyFile
+}
+
+// transportKey возвращает ключ транспорта прокси в пуле. Настройки TLS
+// входят в ключ: при их изменении URL прокси остается прежним, а
+// транспорт с устаревшим tlsConfig не должен использоваться.
+func (p *Proxy) transportKey() string {
+	return p.URL + "|" + p.tlsSettings()
+}
+
+// inheritStats переносит накопленную статистику с прежней записи прокси.
+// Вызывается под pm.mu, пока новая запись еще не опубликована.
+func (p *Proxy) inheritStats(old *Proxy) {
+	p.ErrorCount = atomic.LoadInt64(&old.ErrorCount)
+	p.UsageCount = atomic.LoadInt64(&old.UsageCount)
+	p.RetryCount = atomic.LoadInt64(&old.RetryCount)
+	p.lastUsed = atomic.LoadInt64(&old.lastUsed)
+	p.latencyBits = atomic.LoadUint64(&old.latencyBits)
+	p.health = atomic.LoadInt32(&old.health)
+	p.LastCheck = old.LastCheck
+	p.CheckLatency = old.CheckLatency
+	p.CheckFailures = old.CheckFailures
+	p.LastCheckErr = old.LastCheckErr
+	p.breaker = old.breaker
+	p.latency = old.latency
+	p.stats = old.stats
+}
+
+// OnProxyRemoved регистрирует обработчик, вызываемый после того, как
+// удаленный из списка прокси завершил все запросы
+func (pm *ProxyManager) OnProxyRemoved(fn func(p *Proxy)) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.removedHandlers = append(pm.removedHandlers, fn)
+}
+
+// Reload перечитывает файл прокси и применяет изменения без перезапуска.
+// Прокси сопоставляются по host:port:user: оставшиеся сохраняют статистику,
+// удаленные перестают выдаваться и освобождаются после завершения запросов.
+func (pm *ProxyManager) Reload() error {
+	pm.reloadMu.Lock()
+	defer pm.reloadMu.Unlock()
+
+	loaded, err := loadProxiesFromFile(pm.config)
+	if err != nil {
+		return fmt.Errorf("ошибка при загрузке прокси: %v", err)
+	}
+
+	pm.mu.Lock()
+
+	current := make(map[string]*Proxy, len(pm.proxies))
+	for _, p := range pm.proxies {
+		current[p.Key()] = p
+	}
+
+	var next, removed []*Proxy
+	added, updated := 0, 0
+	for _, p := range loaded {
+		key := p.Key()
+		old, exists := current[key]
+		if !exists {
+			p.breaker = newCircuitBreaker(pm.config)
+			p.latency = newLatencyRecorder()
+			p.stats = newProxyStats()
+			next = append(next, p)
+			added++
+			continue
+		}
+		delete(current, key)
+
+		if old.URL == p.URL && old.tlsSettings() == p.tlsSettings() {
+			// Прокси не изменился, обновляем только вес, метки и отключение
+			old.Weight = p.Weight
+			old.Tags = p.Tags
+			old.setDisabled(p.Disabled())
+			next = append(next, old)
+			continue
+		}
+
+		// Изменились учетные данные или настройки TLS: новая запись наследует статистику,
+		// а прежняя освобождается как удаленная
+		p.inheritStats(old)
+		next = append(next, p)
+		removed = append(removed, old)
+		updated++
+	}
+	for _, p := range current {
+		removed = append(removed, p)
+	}
+
+	pm.proxies = next
+	pm.byURL = make(map[string]*Proxy, len(next))
+	for _, p := range next {
+		pm.byURL[p.URL] = p
+	}
+	pm.rebuildPool()
+	pm.mu.Unlock()
+
+	for _, p := range removed {
+		go pm.drainProxy(p)
+	}
+
+	log.Printf("Список прокси перезагружен: всего %d, добавлено %d, изменено %d, удалено %d",
+		len(next), added, updated, len(removed)-updated)
+	return nil
+}
+
+// drainProxy дожидается завершения запросов через удаленный прокси
+// (не дольше drain_timeout) и вызывает обработчики удаления
+func (pm *ProxyManager) drainProxy(p *Proxy) {
+	deadline := time.Now().Add(time.Duration(pm.config.DrainTimeout) * time.Second)
+	for atomic.LoadInt64(&p.ActiveConns) > 0 && time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	pm.mu.RLock()
+	active := pm.byURL[p.URL] == p
+	handlers := pm.removedHandlers
+	pm.mu.RUnlock()
+
+	// Эта же запись могла вернуться в список при следующей перезагрузке.
+	// Запись с тем же URL, но другими настройками TLS, — уже другой прокси.
+	if active {
+		return
+	}
+
+	if conns := atomic.LoadInt64(&p.ActiveConns); conns > 0 {
+		log.Printf("Прокси %s:%d удален, не дождавшись завершения %d запросов", p.Host, p.Port, conns)
+	}
+	for _, fn := range handlers {
+		fn(p)
+	}
+}
+
+// StartReloadWatcher запускает проверку времени изменения файла прокси
+// с интервалом proxies_reload_interval и перезагружает список при изменении
+func (pm *ProxyManager) StartReloadWatcher() {
+	if pm.config.ReloadInterval <= 0 {
+		return
+	}
+
+	var lastModTime time.Time
+	if info, err := os.Stat(pm.config.ProxiesFile); err == nil {
+		lastModTime = info.ModTime()
+	}
+
+	ticker := time.NewTicker(time.Duration(pm.config.ReloadInterval) * time.Second)
+	go func() {
+		for range ticker.C {
+			info, err := os.Stat(pm.config.ProxiesFile)
+			if err != nil {
+				log.Printf("Ошибка проверки файла прокси: %v", err)
+				continue
+			}
+			if info.ModTime().Equal(lastModTime) {
+				continue
+			}
+			lastModTime = info.ModTime()
+
+			if err := pm.Reload(); err != nil {
+				log.Printf("Ошибка перезагрузки прокси: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// proxyStateVersion — версия формата файла состояния. Файл другой версии
+// не восстанавливается. Версия 2: ячейки задержки по минуте, 8 подкорзин.
+const proxyStateVersion = 2
+
+// savedProxyState — содержимое файла состояния state_file
+type savedProxyState struct {
+	Version int                   `json:"version"`
+	SavedAt time.Time             `json:"saved_at"`
+	Proxies map[string]savedProxy `json:"proxies"` // host:port:user -> статистика
+}
+
+// savedProxy — сохраняемая статистика одного прокси
+type savedProxy struct {
+	UsageCount   int64     `json:"usage_count"`
+	ErrorCount   int64     `json:"error_count"`
+	RetryCount   int64     `json:"retry_count"`
+	SuccessCount int64     `json:"success_count"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+	LastUsed     time.Time `json:"last_used"`
+	LatencyMs    float64   `json:"latency_ms"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastErrorAt  time.Time `json:"last_error_at"`
+
+	Health         string    `json:"health"`
+	LastCheck      time.Time `json:"last_check"`
+	CheckLatencyMs float64   `json:"check_latency_ms"`
+	CheckFailures  int       `json:"check_failures"`
+	LastCheckErr   string    `json:"last_check_error,omitempty"`
+
+	Circuit savedCircuit       `json:"circuit"`
+	Latency []savedLatencySlot `json:"latency,omitempty"`
+}
+
+// parseHealthState возвращает состояние по его текстовому представлению
+func parseHealthState(s string) HealthState {
+	switch s {
+	case HealthHealthy.String():
+		return HealthHealthy
+	case HealthUnhealthy.String():
+		return HealthUnhealthy
+	default:
+		return HealthUnknown
+	}
+}
+
+// saveState возвращает статистику прокси для сохранения.
+// Вызывается под pm.mu, которым защищены результаты проверок.
+func (p *Proxy) saveState() savedProxy {
+	lastError, lastErrorAt := p.stats.LastError()
+	return savedProxy{
+		UsageCount:     atomic.LoadInt64(&p.UsageCount),
+		ErrorCount:     atomic.LoadInt64(&p.ErrorCount),
+		RetryCount:     atomic.LoadInt64(&p.RetryCount),
+		SuccessCount:   atomic.LoadInt64(&p.stats.successCount),
+		BytesIn:        atomic.LoadInt64(&p.stats.bytesIn),
+		BytesOut:       atomic.LoadInt64(&p.stats.bytesOut),
+		LastUsed:       p.LastUsed(),
+		LatencyMs:      p.LatencyEWMA(),
+		LastError:      lastError,
+		LastErrorAt:    lastErrorAt,
+		Health:         p.Health().String(),
+		LastCheck:      p.LastCheck,
+		CheckLatencyMs: float64(p.CheckLatency) / float64(time.Millisecond),
+		CheckFailures:  p.CheckFailures,
+		LastCheckErr:   p.LastCheckErr,
+		Circuit:        p.breaker.save(),
+		Latency:        p.latency.save(),
+	}
+}
+
+// restoreState восстанавливает сохраненную статистику прокси. Результаты
+// активной проверки восстанавливаются только при включенной проверке,
+// иначе нерабочий прокси не смог бы вернуться в ротацию.
+// Вызывается под pm.mu.
+func (p *Proxy) restoreState(saved savedProxy, restoreHealth bool) {
+	atomic.StoreInt64(&p.UsageCount, saved.UsageCount)
+	atomic.StoreInt64(&p.ErrorCount, saved.ErrorCount)
+	atomic.StoreInt64(&p.RetryCount, saved.RetryCount)
+	atomic.StoreInt64(&p.stats.successCount, saved.SuccessCount)
+	atomic.StoreInt64(&p.stats.bytesIn, saved.BytesIn)
+	atomic.StoreInt64(&p.stats.bytesOut, saved.BytesOut)
+	if !saved.LastUsed.IsZero() {
+		atomic.StoreInt64(&p.lastUsed, saved.LastUsed.UnixNano())
+	}
+	if saved.LatencyMs > 0 {
+		atomic.StoreUint64(&p.latencyBits, math.Float64bits(saved.LatencyMs))
+	}
+	if saved.LastError != "" {
+		p.stats.mu.Lock()
+		p.stats.lastError = saved.LastError
+		p.stats.lastErrorAt = saved.LastErrorAt
+		p.stats.mu.Unlock()
+	}
+
+	if restoreHealth {
+		p.setHealth(parseHealthState(saved.Health))
+		p.LastCheck = saved.LastCheck
+		p.CheckLatency = time.Duration(saved.CheckLatencyMs * float64(time.Millisecond))
+		p.CheckFailures = saved.CheckFailures
+		p.LastCheckErr = saved.LastCheckErr
+	}
+
+	p.breaker.restore(saved.Circuit)
+	p.latency.restore(saved.Latency)
+}
+
+// SaveState записывает статистику прокси в state_file
+func (pm *ProxyManager) SaveState() error {
+	if pm.config.StateFile == "" {
+		return nil
+	}
+
+	state := savedProxyState{
+		Version: proxyStateVersion,
+		SavedAt: time.Now(),
+	}
+	pm.mu.RLock()
+	state.Proxies = make(map[string]savedProxy, len(pm.proxies))
+	for _, p := range pm.proxies {
+		state.Proxies[p.Key()] = p.saveState()
+	}
+	pm.mu.RUnlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(pm.config.StateFile, data)
+}
+
+// restoreState восстанавливает статистику прокси из state_file.
+// Прокси сопоставляются по host:port:user, записи о прокси, которых
+// больше нет в списке, пропускаются. Отсутствие файла не считается ошибкой.
+func (pm *ProxyManager) restoreState() error {
+	if pm.config.StateFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(pm.config.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state savedProxyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("ошибка парсинга %s: %v", pm.config.StateFile, err)
+	}
+	if state.Version != proxyStateVersion {
+		return fmt.Errorf("версия файла %s %d не поддерживается", pm.config.StateFile, state.Version)
+	}
+
+	pm.mu.Lock()
+	restored := 0
+	for _, p := range pm.proxies {
+		if saved, ok := state.Proxies[p.Key()]; ok {
+			p.restoreState(saved, pm.config.CheckInterval >= 0)
+			restored++
+		}
+	}
+	total := len(pm.proxies)
+	pm.mu.Unlock()
+
+	log.Printf("Восстановлена статистика %d из %d прокси (сохранена %s)",
+		restored, total, state.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// StartStateSaver сохраняет статистику прокси с интервалом state_interval
+func (pm *ProxyManager) StartStateSaver() {
+	if pm.config.StateFile == "" || pm.config.StateInterval < 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(pm.config.StateInterval) * time.Second)
+	go func() {
+		for range ticker.C {
+			if err := pm.SaveState(); err != nil {
+				log.Printf("Ошибка сохранения состояния прокси: %v", err)
+			}
+		}
+	}()
+}
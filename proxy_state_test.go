@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stateTestProxies — список прокси для тестов сохранения состояния
+const stateTestProxies = `[
+  {"host":"10.0.0.1","port":1080,"user":"u","pass":"p"},
+  {"host":"10.0.0.2","port":1080}
+]`
+
+// savedStateJSON возвращает сохраняемую статистику прокси в виде JSON
+func savedStateJSON(t *testing.T, p *Proxy) string {
+	t.Helper()
+	data, err := json.Marshal(p.saveState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestProxyStateRoundTrip(t *testing.T) {
+	settings := map[string]interface{}{
+		"state_file":                 filepath.Join(t.TempDir(), "state.json"),
+		"check_interval":             30,
+		"check_failures":             2,
+		"breaker_consecutive_errors": 2,
+		"breaker_base_backoff":       600,
+	}
+	pm := newTestProxyManager(t, settings, stateTestProxies)
+	tripped, used := pm.proxies[0], pm.proxies[1]
+
+	// Первый прокси на карантине и помечен нерабочим, второй работает
+	tripped.markUsed(time.Now())
+	pm.ReleaseProxy(tripped)
+	pm.RecordProxySuccess(tripped.URL, 80*time.Millisecond)
+	pm.IncrementProxyErrorCount(tripped.URL, "dial tcp: connection refused")
+	pm.IncrementProxyErrorCount(tripped.URL, "dial tcp: connection refused")
+	pm.IncrementProxyRetryCount(tripped)
+	checkErr := errors.New("CONNECT: connection refused")
+	pm.recordCheckResult(tripped, 0, checkErr)
+	pm.recordCheckResult(tripped, 0, checkErr)
+
+	for i := 0; i < 5; i++ {
+		used.markUsed(time.Now())
+		pm.ReleaseProxy(used)
+		pm.RecordProxySuccess(used.URL, time.Duration(10+i)*time.Millisecond)
+	}
+	atomic.AddInt64(&used.stats.bytesIn, 4096)
+	atomic.AddInt64(&used.stats.bytesOut, 512)
+	pm.recordCheckResult(used, 25*time.Millisecond, nil)
+
+	if tripped.breaker.State(time.Now()) != CircuitOpen || tripped.Health() != HealthUnhealthy {
+		t.Fatalf("исходное состояние: автомат %v, проверка %v", tripped.breaker.State(time.Now()), tripped.Health())
+	}
+	want := []string{savedStateJSON(t, tripped), savedStateJSON(t, used)}
+	if err := pm.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestProxyManager(t, settings, stateTestProxies)
+	for i, p := range restored.proxies {
+		if got := savedStateJSON(t, p); got != want[i] {
+			t.Errorf("прокси %s восстановлен как\n%s\nожидалось\n%s", p.Key(), got, want[i])
+		}
+	}
+	p := restored.proxies[0]
+	if p.breaker.State(time.Now()) != CircuitOpen || p.Health() != HealthUnhealthy {
+		t.Fatalf("восстановлено: автомат %v, проверка %v", p.breaker.State(time.Now()), p.Health())
+	}
+	if summary := restored.proxies[1].latency.Summary()["1m"]; summary.Count != 5 || summary.Max != 14 {
+		t.Fatalf("восстановленная задержка: %+v", summary)
+	}
+	if got := restored.GetProxyForEndpoint("", nil); got != restored.proxies[1] {
+		t.Fatalf("выдан прокси %v вместо рабочего", got)
+	}
+
+	// Без активной проверки ее результаты не восстанавливаются
+	settings["check_interval"] = -1
+	restored = newTestProxyManager(t, settings, stateTestProxies)
+	if p := restored.proxies[0]; p.Health() != HealthUnknown || p.CheckFailures != 0 || atomic.LoadInt64(&p.ErrorCount) != 2 {
+		t.Fatalf("при отключенной проверке: %v, неудач %d, ошибок %d", p.Health(), p.CheckFailures, p.ErrorCount)
+	}
+
+	// Статистика сопоставляется по host:port:user: у прокси с другим логином ее нет
+	restored = newTestProxyManager(t, settings, `[{"host":"10.0.0.1","port":1080,"user":"v","pass":"p"}]`)
+	if n := atomic.LoadInt64(&restored.proxies[0].UsageCount); n != 0 {
+		t.Fatalf("чужая статистика восстановлена: запросов %d", n)
+	}
+}
+
+func TestProxyStateRejectsFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	pm := newTestProxyManager(t, map[string]interface{}{"state_file": stateFile}, stateTestProxies)
+	if err := pm.restoreState(); err != nil {
+		t.Fatalf("отсутствующий файл: %v", err)
+	}
+
+	atomic.StoreInt64(&pm.proxies[0].UsageCount, 7)
+	if err := pm.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state savedProxyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	state.Version = proxyStateVersion + 1
+	otherVersion, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, data, err string
+	}{
+		{"другая версия", string(otherVersion), "версия файла"},
+		{"поврежденный файл", string(data[:len(data)/2]), "ошибка парсинга"},
+	} {
+		if err := ioutil.WriteFile(stateFile, []byte(tc.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		restored := newTestProxyManager(t, map[string]interface{}{"state_file": stateFile}, stateTestProxies)
+		if n := atomic.LoadInt64(&restored.proxies[0].UsageCount); n != 0 {
+			t.Fatalf("%s: статистика восстановлена, запросов %d", tc.name, n)
+		}
+		if err := restored.restoreState(); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("%s: ошибка %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyStats — накопленная статистика трафика и исходов запросов прокси.
+// Переходит к новой записи прокси при перезагрузке списка, поэтому ее
+// продолжают пополнять транспорты, созданные для прежней записи.
+type proxyStats struct {
+	successCount  int64 // Успешные запросы
+	bytesIn       int64 // Байты, полученные от прокси
+	bytesOut      int64 // Байты, отправленные прокси
+	activeTunnels int64 // Открытые CONNECT-туннели
+
+	mu          sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// newProxyStats создает пустую статистику прокси
+func newProxyStats() *proxyStats {
+	return &proxyStats{}
+}
+
+// recordError запоминает последнюю ошибку прокси
+func (s *proxyStats) recordError(reason string) {
+	s.mu.Lock()
+	s.lastError = reason
+	s.lastErrorAt = time.Now()
+	s.mu.Unlock()
+}
+
+// reset обнуляет накопленную статистику. Открытые туннели не сбрасываются:
+// их счетчик уменьшается при закрытии.
+func (s *proxyStats) reset() {
+	atomic.StoreInt64(&s.successCount, 0)
+	atomic.StoreInt64(&s.bytesIn, 0)
+	atomic.StoreInt64(&s.bytesOut, 0)
+	s.mu.Lock()
+	s.lastError = ""
+	s.lastErrorAt = time.Time{}
+	s.mu.Unlock()
+}
+
+// LastError возвращает последнюю ошибку прокси и время, когда она произошла
+func (s *proxyStats) LastError() (string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastError, s.lastErrorAt
+}
+
+// countedConn учитывает трафик соединения в статистике прокси
+type countedConn struct {
+	net.Conn
+	stats *proxyStats
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.stats.bytesIn, int64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.stats.bytesOut, int64(n))
+	return n, err
+}
+
+// countConn оборачивает соединение с прокси для учета трафика
+func (p *Proxy) countConn(conn net.Conn) net.Conn {
+	return &countedConn{Conn: conn, stats: p.stats}
+}
+
+// SuccessRate возвращает долю успешных запросов через прокси и false,
+// если запросов еще не было
+func (p *Proxy) SuccessRate() (float64, bool) {
+	successes := atomic.LoadInt64(&p.stats.successCount)
+	total := successes + atomic.LoadInt64(&p.ErrorCount)
+	if total == 0 {
+		return 0, false
+	}
+	return float64(successes) / float64(total), true
+}
+
+// attemptFailure описывает причину неудачной попытки запроса
+func attemptFailure(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+// proxySortKeys — поля, по которым можно упорядочить список /proxies.
+// Прокси без значения (например, без замеров задержки) идут в конце.
+var proxySortKeys = map[string]func(p *Proxy) (float64, bool){
+	"latency": func(p *Proxy) (float64, bool) {
+		latency := p.LatencyEWMA()
+		return latency, latency > 0
+	},
+	"success_rate": func(p *Proxy) (float64, bool) {
+		return p.SuccessRate()
+	},
+	"errors": func(p *Proxy) (float64, bool) {
+		return float64(atomic.LoadInt64(&p.ErrorCount)), true
+	},
+	"usage": func(p *Proxy) (float64, bool) {
+		return float64(atomic.LoadInt64(&p.UsageCount)), true
+	},
+	"active": func(p *Proxy) (float64, bool) {
+		return float64(atomic.LoadInt64(&p.ActiveConns) + atomic.LoadInt64(&p.stats.activeTunnels)), true
+	},
+	"bytes": func(p *Proxy) (float64, bool) {
+		return float64(atomic.LoadInt64(&p.stats.bytesIn) + atomic.LoadInt64(&p.stats.bytesOut)), true
+	},
+	"consecutive_failures": func(p *Proxy) (float64, bool) {
+		return float64(p.breaker.ConsecutiveErrors()), true
+	},
+	"last_used": func(p *Proxy) (float64, bool) {
+		lastUsed := atomic.LoadInt64(&p.lastUsed)
+		return float64(lastUsed), lastUsed > 0
+	},
+}
+
+// proxyStatsQuery — параметры выборки /proxies?sort=latency&limit=50.
+// Знак минус перед полем сортировки задает порядок по убыванию.
+type proxyStatsQuery struct {
+	sort  string
+	desc  bool
+	limit int // 0 — без ограничения
+}
+
+// parseProxyStatsQuery разбирает параметры выборки списка прокси
+func parseProxyStatsQuery(values url.Values) (proxyStatsQuery, error) {
+	var query proxyStatsQuery
+	if value := values.Get("sort"); value != "" {
+		query.desc = strings.HasPrefix(value, "-")
+		query.sort = strings.TrimPrefix(value, "-")
+		if _, ok := proxySortKeys[query.sort]; !ok {
+			keys := make([]string, 0, len(proxySortKeys))
+			for key := range proxySortKeys {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			return query, fmt.Errorf("Неизвестное поле сортировки %q, допустимые: %s", query.sort, strings.Join(keys, ", "))
+		}
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return query, fmt.Errorf("Некорректный limit: %s", value)
+		}
+		query.limit = limit
+	}
+	return query, nil
+}
+
+// apply упорядочивает и ограничивает список прокси
+func (q proxyStatsQuery) apply(proxies []*Proxy) []*Proxy {
+	if q.sort != "" {
+		key := proxySortKeys[q.sort]
+		sort.SliceStable(proxies, func(i, j int) bool {
+			vi, oki := key(proxies[i])
+			vj, okj := key(proxies[j])
+			if !oki || !okj {
+				return oki && !okj
+			}
+			if q.desc {
+				return vi > vj
+			}
+			return vi < vj
+		})
+	}
+	if q.limit > 0 && len(proxies) > q.limit {
+		proxies = proxies[:q.limit]
+	}
+	return proxies
+}
+
+// proxyStatsEntry возвращает статистику одного прокси для /proxies.
+// Вызывается под pm.mu: вес, метки и результаты проверок изменяются под ним.
+func proxyStatsEntry(p *Proxy, now time.Time) map[string]interface{} {
+	entry := map[string]interface{}{
+		"id":                   p.Key(),
+		"scheme":               p.Scheme,
+		"host":                 p.Host,
+		"port":                 p.Port,
+		"weight":               p.Weight,
+		"tags":                 p.Tags,
+		"disabled":             p.Disabled(),
+		"usage_count":          atomic.LoadInt64(&p.UsageCount),
+		"success_count":        atomic.LoadInt64(&p.stats.successCount),
+		"active":               atomic.LoadInt64(&p.ActiveConns),
+		"active_tunnels":       atomic.LoadInt64(&p.stats.activeTunnels),
+		"bytes_in":             atomic.LoadInt64(&p.stats.bytesIn),
+		"bytes_out":            atomic.LoadInt64(&p.stats.bytesOut),
+		"latency_ms":           p.LatencyEWMA(),
+		"error_count":          atomic.LoadInt64(&p.ErrorCount),
+		"retry_count":          atomic.LoadInt64(&p.RetryCount),
+		"consecutive_failures": p.breaker.ConsecutiveErrors(),
+		"last_used":            p.LastUsed(),
+		"health":               p.Health().String(),
+		"last_check":           p.LastCheck,
+		"check_ms":             p.CheckLatency.Milliseconds(),
+		"check_error":          p.LastCheckErr,
+		"circuit":              p.breaker.Snapshot(now),
+		"latency":              p.latency.Summary(),
+	}
+	if rate, ok := p.SuccessRate(); ok {
+		entry["success_rate"] = math.Round(rate*10000) / 10000
+	}
+	if lastError, at := p.stats.LastError(); lastError != "" {
+		entry["last_error"] = lastError
+		entry["last_error_at"] = at
+	}
+	return entry
+}
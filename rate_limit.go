@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errRateLimited возвращается, если у всех подходящих прокси исчерпан
+// лимит запросов к эндпоинту и токен не освободился за rate_limit_wait_ms
+var errRateLimited = errors.New("исчерпан лимит запросов через все прокси")
+
+// RateLimit задает лимит запросов к эндпоинту через один прокси
+type RateLimit struct {
+	RPS   float64 `json:"rps"`   // Запросов в секунду, 0 — без ограничения
+	Burst int     `json:"burst"` // Размер пачки (по умолчанию — ceil(rps), не меньше 1)
+}
+
+// tokenBucket — ведро токенов для пары (прокси, эндпоинт)
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+// refill пополняет ведро на момент now. Вызывается под b.mu.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// ready сообщает, есть ли в ведре токен
+func (b *tokenBucket) ready(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+// take забирает токен, если он есть
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refund возвращает токен, взятый для неиспользованного прокси
+func (b *tokenBucket) refund() {
+	b.mu.Lock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+	b.mu.Unlock()
+}
+
+// wait возвращает время до появления токена
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// bucketKey — ключ ведра: идентичность прокси переживает перезагрузку списка
+type bucketKey struct {
+	proxy    string
+	endpoint string
+}
+
+// rateLimiter хранит ведра токенов и охлаждение для пар (прокси, эндпоинт)
+type rateLimiter struct {
+	defaultLimit RateLimit
+	limits       map[string]RateLimit // Лимиты отдельных эндпоинтов
+	buckets      sync.Map             // bucketKey -> *tokenBucket
+	cooldowns    sync.Map             // bucketKey -> *int64, время окончания охлаждения (UnixNano)
+}
+
+// newRateLimiter создает лимитер по настройкам конфигурации
+func newRateLimiter(config *Config) *rateLimiter {
+	return &rateLimiter{
+		defaultLimit: RateLimit{RPS: config.RateLimitRPS, Burst: config.RateLimitBurst},
+		limits:       config.EndpointRateLimits,
+	}
+}
+
+// limitFor возвращает лимит для эндпоинта. Пустое имя (туннели, проверки)
+// не ограничивается.
+func (rl *rateLimiter) limitFor(endpoint string) (RateLimit, bool) {
+	if endpoint == "" {
+		return RateLimit{}, false
+	}
+	limit, ok := rl.limits[endpoint]
+	if !ok {
+		limit = rl.defaultLimit
+	}
+	return limit, limit.RPS > 0
+}
+
+// enabled сообщает, ограничены ли запросы к эндпоинту
+func (rl *rateLimiter) enabled(endpoint string) bool {
+	_, ok := rl.limitFor(endpoint)
+	return ok
+}
+
+// bucket возвращает ведро для прокси и эндпоинта или nil, если лимита нет
+func (rl *rateLimiter) bucket(p *Proxy, endpoint string, now time.Time) *tokenBucket {
+	limit, ok := rl.limitFor(endpoint)
+	if !ok {
+		return nil
+	}
+
+	key := bucketKey{proxy: p.Key(), endpoint: endpoint}
+	if b, ok := rl.buckets.Load(key); ok {
+		return b.(*tokenBucket)
+	}
+
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(limit.RPS))
+	}
+	b, _ := rl.buckets.LoadOrStore(key, &tokenBucket{
+		tokens: burst,
+		last:   now,
+		rate:   limit.RPS,
+		burst:  burst,
+	})
+	return b.(*tokenBucket)
+}
+
+// cooldown запрещает запросы к эндпоинту через прокси на время d
+func (rl *rateLimiter) cooldown(p *Proxy, endpoint string, d time.Duration) {
+	if endpoint == "" {
+		return
+	}
+	until := time.Now().Add(d).UnixNano()
+	v, _ := rl.cooldowns.LoadOrStore(bucketKey{proxy: p.Key(), endpoint: endpoint}, new(int64))
+	ptr := v.(*int64)
+	for {
+		old := atomic.LoadInt64(ptr)
+		if old >= until || atomic.CompareAndSwapInt64(ptr, old, until) {
+			return
+		}
+	}
+}
+
+// cooldownLeft возвращает оставшееся время охлаждения прокси для эндпоинта
+func (rl *rateLimiter) cooldownLeft(p *Proxy, endpoint string, now time.Time) time.Duration {
+	if endpoint == "" {
+		return 0
+	}
+	v, ok := rl.cooldowns.Load(bucketKey{proxy: p.Key(), endpoint: endpoint})
+	if !ok {
+		return 0
+	}
+	if left := time.Duration(atomic.LoadInt64(v.(*int64)) - now.UnixNano()); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// forget удаляет ведра и охлаждение прокси с идентичностью key
+func (rl *rateLimiter) forget(key string) {
+	for _, m := range []*sync.Map{&rl.buckets, &rl.cooldowns} {
+		m.Range(func(k, _ interface{}) bool {
+			if k.(bucketKey).proxy == key {
+				m.Delete(k)
+			}
+			return true
+		})
+	}
+}
+
+// CooldownProxy охлаждает прокси для эндпоинта после ответа об ограничении
+// частоты запросов: до истечения d прокси не выдается для этого эндпоинта
+func (pm *ProxyManager) CooldownProxy(p *Proxy, endpoint string, d time.Duration) {
+	pm.limiter.cooldown(p, endpoint, d)
+}
+
+// forgetRateLimits удаляет ведра прокси, удаленного из списка, если его
+// не заменил прокси с той же идентичностью
+func (pm *ProxyManager) forgetRateLimits(p *Proxy) {
+	key := p.Key()
+	pm.mu.RLock()
+	for _, current := range pm.proxies {
+		if current.Key() == key {
+			pm.mu.RUnlock()
+			return
+		}
+	}
+	pm.mu.RUnlock()
+
+	pm.limiter.forget(key)
+}
+
+// WaitProxyForEndpoint выбирает прокси для эндпоинта, как GetProxyForEndpoint,
+// но если у всех подходящих прокси исчерпан лимит запросов или идет
+// охлаждение, ждет освобождения не дольше maxWait. Возвращает errNoProxies,
+// если подходящих прокси нет, и errRateLimited, если ни один не освободился.
+func (pm *ProxyManager) WaitProxyForEndpoint(ctx context.Context, endpoint string, exclude map[*Proxy]bool, maxWait time.Duration) (*Proxy, error) {
+	deadline := time.Now().Add(maxWait)
+	for {
+		if p := pm.GetProxyForEndpoint(endpoint, exclude); p != nil {
+			return p, nil
+		}
+		wait, ok := pm.tokenWait(endpoint, exclude)
+		if !ok || (wait == 0 && !pm.limiter.enabled(endpoint)) {
+			return nil, errNoProxies
+		}
+		if wait < time.Millisecond {
+			// Токен есть, но прокси не достался: даем другим потокам завершить выбор
+			wait = time.Millisecond
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return nil, errRateLimited
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// RateLimitRetryAfter возвращает время до появления токена у любого
+// подходящего прокси — значение для заголовка Retry-After
+func (pm *ProxyManager) RateLimitRetryAfter(endpoint string) time.Duration {
+	wait, _ := pm.tokenWait(endpoint, nil)
+	return wait
+}
+
+// tokenWait возвращает минимальное время до появления токена и окончания
+// охлаждения среди прокси, которые подошли бы для эндпоинта без учета лимита
+func (pm *ProxyManager) tokenWait(endpoint string, exclude map[*Proxy]bool) (time.Duration, bool) {
+	now := time.Now()
+	min := time.Duration(-1)
+	for _, p := range pm.loadPool().proxies {
+		if exclude[p] || p.Disabled() || p.Health() == HealthUnhealthy || !p.breaker.Ready(now) {
+			continue
+		}
+		wait := pm.limiter.cooldownLeft(p, endpoint, now)
+		if b := pm.limiter.bucket(p, endpoint, now); b != nil {
+			if bucketWait := b.wait(now); bucketWait > wait {
+				wait = bucketWait
+			}
+		}
+		if min < 0 || wait < min {
+			min = wait
+		}
+	}
+	return min, min >= 0
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWaitProxyForEndpointTokens(t *testing.T) {
+	pm := newTestProxyManager(t, map[string]interface{}{"rate_limit_rps": 1, "rate_limit_burst": 1},
+		`[{"host":"10.0.0.1","port":1080,"weight":1}]`)
+
+	p, err := pm.WaitProxyForEndpoint(context.Background(), "ep", nil, 0)
+	if err != nil {
+		t.Fatalf("первый запрос: %v", err)
+	}
+	pm.ReleaseProxy(p)
+
+	if _, err := pm.WaitProxyForEndpoint(context.Background(), "ep", nil, 10*time.Millisecond); err != errRateLimited {
+		t.Fatalf("второй запрос без токена: %v, ожидалось errRateLimited", err)
+	}
+	if wait := pm.RateLimitRetryAfter("ep"); wait <= 0 || wait > time.Second {
+		t.Fatalf("Retry-After = %v", wait)
+	}
+}
+
+func TestWaitProxyForEndpointSkipsDisabled(t *testing.T) {
+	pm := newTestProxyManager(t, map[string]interface{}{"rate_limit_rps": 10},
+		`[{"host":"10.0.0.1","port":1080,"weight":1,"disabled":true},
+		  {"host":"10.0.0.2","port":1080,"weight":1,"disabled":true}]`)
+
+	start := time.Now()
+	_, err := pm.WaitProxyForEndpoint(context.Background(), "ep", nil, time.Second)
+	if err != errNoProxies {
+		t.Fatalf("ошибка %v, ожидалось errNoProxies", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("ожидание %v вместо немедленного отказа", elapsed)
+	}
+	if _, ok := pm.tokenWait("ep", nil); ok {
+		t.Fatal("tokenWait учитывает отключенные прокси")
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayMaxLine — максимальная длина строки файла захвата
+const replayMaxLine = 16 * 1024 * 1024
+
+// replayRecord — запрос из файла захвата. Формат совместим с журналом
+// запросов (access_log): используются ts, method, path и query, а также
+// необязательные headers и body. Журнал сохраняет тело и строку запроса
+// только при access_log_body_max > 0; записи JSON-RPC без тела и записи
+// с обрезанным телом не отправляются, так как параметры вызова неизвестны.
+type replayRecord struct {
+	Time          time.Time         `json:"ts"`
+	Method        string            `json:"method"`
+	Path          string            `json:"path"`
+	Query         string            `json:"query,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Body          json.RawMessage   `json:"body,omitempty"` // JSON-значение или строка с телом
+	BodyTruncated bool              `json:"body_truncated,omitempty"`
+	RPCMethod     string            `json:"rpc_method,omitempty"`
+}
+
+// replayOptions — параметры команды replay
+type replayOptions struct {
+	input          string
+	target         string
+	direct         bool
+	configFile     string
+	preserveTiming bool
+	speed          float64
+	concurrency    int
+	timeout        time.Duration
+	limit          int
+}
+
+// replayOutcome — результат отправки одного запроса
+type replayOutcome struct {
+	endpoint string
+	status   int
+	latency  time.Duration
+	err      string
+}
+
+// replayStats накапливает результаты для итогового отчета
+type replayStats struct {
+	mu        sync.Mutex
+	total     int
+	failed    int
+	statuses  map[int]int
+	errors    map[string]int
+	latency   [latencyBucketCount]uint64
+	max       uint64
+	endpoints map[string]*replayEndpointStats
+}
+
+// replayEndpointStats — результаты по одному эндпоинту
+type replayEndpointStats struct {
+	total, failed int
+	latency       [latencyBucketCount]uint64
+	max           uint64
+}
+
+// runReplay выполняет команду replay: повторно отправляет запросы из файла
+// захвата через запущенный прокси-сервер или напрямую эндпоинтам и печатает
+// отчет о задержках и ошибках. Возвращает код завершения.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	opts := replayOptions{}
+	fs.StringVar(&opts.input, "input", "access.jsonl", "Файл захвата запросов (JSON Lines), - — stdin")
+	fs.StringVar(&opts.target, "target", "http://127.0.0.1:8082", "Адрес прокси-сервера, на который отправляются запросы")
+	fs.BoolVar(&opts.direct, "direct", false, "Отправлять запросы напрямую эндпоинтам из конфигурации, минуя прокси-сервер")
+	fs.StringVar(&opts.configFile, "config", "config.json", "Путь к файлу конфигурации (для -direct)")
+	fs.BoolVar(&opts.preserveTiming, "preserve-timing", false, "Сохранять интервалы между запросами из захвата")
+	fs.Float64Var(&opts.speed, "speed", 1, "Множитель скорости при сохранении интервалов (2 — вдвое быстрее)")
+	fs.IntVar(&opts.concurrency, "concurrency", 10, "Максимум одновременных запросов")
+	fs.DurationVar(&opts.timeout, "timeout", 10*time.Second, "Таймаут одного запроса")
+	fs.IntVar(&opts.limit, "limit", 0, "Отправить не больше указанного числа запросов (0 — все)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if opts.speed <= 0 || opts.concurrency <= 0 {
+		fmt.Fprintln(os.Stderr, "speed и concurrency должны быть положительными")
+		return 2
+	}
+
+	records, skipped, err := readReplayRecords(opts.input, opts.limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ошибка чтения файла захвата: %v\n", err)
+		return 1
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Пропущено запросов без полного тела: %d (см. access_log_body_max)\n", skipped)
+	}
+	if len(records) == 0 {
+		fmt.Fprintln(os.Stderr, "В файле захвата нет запросов")
+		return 1
+	}
+
+	var endpoints *EndpointRegistry
+	if opts.direct {
+		config, err := LoadConfig(opts.configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ошибка загрузки конфигурации: %v\n", err)
+			return 1
+		}
+		if endpoints, err = NewEndpointRegistry(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Ошибка загрузки эндпоинтов: %v\n", err)
+			return 1
+		}
+	}
+
+	client := &http.Client{
+		Timeout: opts.timeout,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: opts.concurrency,
+			DisableCompression:  true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	stats := &replayStats{
+		statuses:  make(map[int]int),
+		errors:    make(map[string]int),
+		endpoints: make(map[string]*replayEndpointStats),
+	}
+	sem := make(chan struct{}, opts.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	first := records[0].Time
+	for _, record := range records {
+		if opts.preserveTiming && !first.IsZero() && !record.Time.IsZero() {
+			offset := time.Duration(float64(record.Time.Sub(first)) / opts.speed)
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(record replayRecord) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			stats.add(replayRequest(client, &opts, endpoints, record))
+		}(record)
+	}
+	wg.Wait()
+
+	stats.print(os.Stdout, time.Since(start))
+	if stats.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readReplayRecords читает запросы из файла захвата, пропуская строки без
+// метода и пути, и возвращает первые limit запросов по времени начала.
+// Второе значение — число пропущенных запросов, тело которых неизвестно.
+func readReplayRecords(path string, limit int) ([]replayRecord, int, error) {
+	var input io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	var records []replayRecord
+	skipped := 0
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), replayMaxLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var record replayRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, 0, fmt.Errorf("строка %d: %v", line, err)
+		}
+		if record.Method == "" || record.Path == "" || record.Method == http.MethodConnect {
+			continue
+		}
+		if record.BodyTruncated || (record.RPCMethod != "" && len(record.Body) == 0) {
+			skipped++
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// Записи журнала идут в порядке завершения запросов, а не их начала,
+	// поэтому limit применяется после сортировки
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, skipped, nil
+}
+
+// body возвращает тело запроса из записи
+func (record *replayRecord) body() []byte {
+	if len(record.Body) > 0 {
+		var text string
+		if json.Unmarshal(record.Body, &text) == nil {
+			return []byte(text)
+		}
+		return record.Body
+	}
+	return nil
+}
+
+// replayRequest отправляет один запрос и возвращает его результат
+func replayRequest(client *http.Client, opts *replayOptions, endpoints *EndpointRegistry, record replayRecord) replayOutcome {
+	components := strings.SplitN(strings.TrimPrefix(record.Path, "/"), "/", 2)
+	outcome := replayOutcome{endpoint: components[0]}
+
+	targetURL := strings.TrimSuffix(opts.target, "/") + record.Path
+	var endpoint *Endpoint
+	if endpoints != nil {
+		var ok bool
+		if endpoint, ok = endpoints.Get(components[0]); !ok {
+			outcome.err = fmt.Sprintf("эндпоинт %s недоступен без прокси-сервера", components[0])
+			return outcome
+		}
+		remainingPath := "/"
+		if len(components) > 1 {
+			remainingPath += components[1]
+		}
+		targetURL = endpoint.TargetURL(remainingPath)
+	}
+	if record.Query != "" {
+		targetURL += "?" + record.Query
+	}
+
+	body := record.body()
+	req, err := http.NewRequest(record.Method, targetURL, bytes.NewReader(body))
+	if err != nil {
+		outcome.err = err.Error()
+		return outcome
+	}
+	for name, value := range record.Headers {
+		req.Header.Set(name, value)
+	}
+	if endpoint != nil {
+		for name, value := range endpoint.Headers {
+			if req.Header.Get(name) == "" {
+				req.Header.Set(name, value)
+			}
+		}
+	}
+	if len(body) > 0 && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		outcome.latency = time.Since(started)
+		outcome.err = err.Error()
+		return outcome
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	outcome.latency = time.Since(started)
+	outcome.status = resp.StatusCode
+	return outcome
+}
+
+// add учитывает результат запроса
+func (s *replayStats) add(outcome replayOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ep, ok := s.endpoints[outcome.endpoint]
+	if !ok {
+		ep = &replayEndpointStats{}
+		s.endpoints[outcome.endpoint] = ep
+	}
+
+	s.total++
+	ep.total++
+	failed := outcome.err != "" || outcome.status >= 400
+	if failed {
+		s.failed++
+		ep.failed++
+	}
+	if outcome.err != "" {
+		s.errors[outcome.err]++
+	} else {
+		s.statuses[outcome.status]++
+	}
+	if outcome.latency > 0 {
+		us := uint64(outcome.latency / time.Microsecond)
+		bucket := latencyBucket(us)
+		s.latency[bucket]++
+		ep.latency[bucket]++
+		if us > s.max {
+			s.max = us
+		}
+		if us > ep.max {
+			ep.max = us
+		}
+	}
+}
+
+// formatPercentiles форматирует процентили и максимум задержки
+func formatPercentiles(counts []uint64, max uint64) string {
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return "нет замеров"
+	}
+	parts := make([]string, 0, len(latencyQuantiles)+1)
+	for _, q := range latencyQuantiles {
+		value := time.Duration(percentile(counts, total, q.Quantile, max)) * time.Microsecond
+		parts = append(parts, fmt.Sprintf("%s=%v", q.Name, value))
+	}
+	parts = append(parts, fmt.Sprintf("max=%v", time.Duration(max)*time.Microsecond))
+	return strings.Join(parts, " ")
+}
+
+// print выводит итоговый отчет
+func (s *replayStats) print(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(w, "Отправлено запросов: %d за %v (%.1f запр/с)\n", s.total, elapsed.Round(time.Millisecond),
+		float64(s.total)/elapsed.Seconds())
+	fmt.Fprintf(w, "Неудачных: %d\n", s.failed)
+	fmt.Fprintf(w, "Задержка: %s\n", formatPercentiles(s.latency[:], s.max))
+
+	codes := make([]int, 0, len(s.statuses))
+	for code := range s.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	if len(codes) > 0 {
+		fmt.Fprintln(w, "Статусы ответа:")
+		for _, code := range codes {
+			fmt.Fprintf(w, "  %d: %d\n", code, s.statuses[code])
+		}
+	}
+
+	if len(s.errors) > 0 {
+		messages := make([]string, 0, len(s.errors))
+		for message := range s.errors {
+			messages = append(messages, message)
+		}
+		sort.Slice(messages, func(i, j int) bool {
+			return s.errors[messages[i]] > s.errors[messages[j]]
+		})
+		fmt.Fprintln(w, "Ошибки:")
+		for _, message := range messages {
+			fmt.Fprintf(w, "  %d × %s\n", s.errors[message], message)
+		}
+	}
+
+	names := make([]string, 0, len(s.endpoints))
+	for name := range s.endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "По эндпоинтам:")
+	for _, name := range names {
+		ep := s.endpoints[name]
+		fmt.Fprintf(w, "  %s: запросов %d, неудачных %d, %s\n", name, ep.total, ep.failed, formatPercentiles(ep.latency[:], ep.max))
+	}
+}
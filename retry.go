@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// errNoProxies возвращается, если для запроса не нашлось ни одного прокси
+var errNoProxies = errors.New("нет доступных прокси")
+
+// upstreamResult — итог отправки запроса к эндпоинту с учетом повторов.
+// Если resp не nil, вызывающий закрывает его и освобождает proxy через close.
+type upstreamResult struct {
+	proxy    *Proxy
+	resp     *http.Response
+	duration time.Duration
+	err      error
+}
+
+// close закрывает ответ и освобождает прокси
+func (res *upstreamResult) close(pm *ProxyManager) {
+	if res.resp != nil {
+		res.resp.Body.Close()
+	}
+	if res.proxy != nil {
+		pm.ReleaseProxy(res.proxy)
+	}
+}
+
+// failureReason описывает причину неудачи для журнала здоровья эндпоинта
+func (res *upstreamResult) failureReason() string {
+	return attemptFailure(res.resp, res.err)
+}
+
+// requestBody хранит тело входящего запроса. Тело, уместившееся в лимит
+// retry_max_body, буферизуется и может быть отправлено повторно через
+// другой прокси; большее тело передается потоком без повторов.
+type requestBody struct {
+	data       []byte    // Буферизованное тело
+	stream     io.Reader // Остаток тела, если оно не уместилось в буфер
+	length     int64     // Длина тела из запроса клиента (-1, если неизвестна)
+	replayable bool      // Можно ли отправить тело повторно
+	rpc        *rpcCall  // Метод JSON-RPC, если тело разобрано (jsonrpc_inspect)
+}
+
+// readRequestBody читает тело запроса не более чем на limit байт
+func readRequestBody(r *http.Request, limit int64) (*requestBody, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return &requestBody{replayable: true}, nil
+	}
+
+	// Заведомо большое тело не буферизуем
+	if r.ContentLength > limit {
+		return &requestBody{stream: r.Body, length: r.ContentLength}, nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения тела запроса: %v", err)
+	}
+
+	// Тело неизвестной длины оказалось больше лимита: дочитываем потоком
+	if int64(len(data)) > limit {
+		return &requestBody{
+			stream: io.MultiReader(bytes.NewReader(data), r.Body),
+			length: r.ContentLength,
+		}, nil
+	}
+
+	return &requestBody{data: data, length: int64(len(data)), replayable: true}, nil
+}
+
+// reader возвращает тело для очередной попытки запроса
+func (b *requestBody) reader() io.Reader {
+	if b.replayable {
+		return bytes.NewReader(b.data)
+	}
+	return b.stream
+}
+
+// shouldRetry сообщает, стоит ли повторить запрос через другой прокси:
+// при ошибке соединения или таймауте, при статусе из retry_status_codes
+// либо при ответе об ограничении частоты запросов
+func (ps *ProxyServer) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if responseClass(resp) == UpstreamRateLimited {
+		return true
+	}
+	for _, code := range ps.config.RetryStatusCodes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireProxy выбирает прокси для первой попытки запроса к эндпоинту,
+// при исчерпании лимита запросов ожидая токен не дольше rate_limit_wait_ms
+func (ps *ProxyServer) acquireProxy(ctx context.Context, endpoint *Endpoint, exclude map[*Proxy]bool) (*Proxy, error) {
+	maxWait := time.Duration(ps.config.RateLimitWaitMs) * time.Millisecond
+	if maxWait < 0 {
+		maxWait = 0
+	}
+	proxy, err := ps.proxyManager.WaitProxyForEndpoint(ctx, endpoint.Name, exclude, maxWait)
+	if err == errRateLimited {
+		ps.metrics.IncrementRateLimited(endpoint.Name)
+	}
+	return proxy, err
+}
+
+// isLocalError сообщает, что запрос не был отправлен из-за нехватки прокси,
+// а не из-за отказа эндпоинта
+func isLocalError(err error) bool {
+	return err == errNoProxies || err == errRateLimited
+}
+
+// isCanceled сообщает, что попытка прервана отменой контекста: клиент
+// закрыл соединение или попытка проиграла хеджирующей. Такой исход не
+// засчитывается ни прокси, ни эндпоинту.
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+// forwardWithRetries отправляет запрос к эндпоинту, повторяя его через
+// другой прокси при ошибке соединения или статусе из retry_status_codes
+func (ps *ProxyServer) forwardWithRetries(ctx context.Context, r *http.Request, endpoint *Endpoint, body *requestBody) upstreamResult {
+	proxy, err := ps.acquireProxy(ctx, endpoint, nil)
+	if err != nil {
+		return upstreamResult{err: err}
+	}
+
+	tried := make(map[*Proxy]bool)
+	for attempt := 0; ; attempt++ {
+		tried[proxy] = true
+		resp, requestDuration, err := ps.doUpstream(ctx, proxy, r, endpoint, body)
+
+		// Следующий прокси выбираем до того, как отбросить текущий ответ:
+		// если замены нет, клиент получит последний ответ как есть
+		var next *Proxy
+		if ps.shouldRetry(resp, err) && body.replayable && attempt < ps.config.MaxRetries && ctx.Err() == nil {
+			next = ps.proxyManager.GetProxyForEndpoint(endpoint.Name, tried)
+		}
+
+		if next != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			ps.proxyManager.IncrementProxyErrorCount(proxy.URL, attemptFailure(resp, err))
+			ps.proxyManager.IncrementProxyRetryCount(proxy)
+			ps.proxyManager.ReleaseProxy(proxy)
+			ps.metrics.IncrementRetries(endpoint.Name)
+			proxy = next
+			continue
+		}
+
+		if err != nil {
+			if isCanceled(err) {
+				ps.proxyManager.AbandonProxyAttempt(proxy)
+			} else {
+				ps.proxyManager.IncrementProxyErrorCount(proxy.URL, attemptFailure(resp, err))
+			}
+			ps.proxyManager.ReleaseProxy(proxy)
+			return upstreamResult{duration: requestDuration, err: err}
+		}
+
+		// Ответ, требующий повтора (ошибка авторизации на прокси, 502 от
+		// прокси, ограничение частоты), засчитывается прокси как ошибка, даже
+		// если повторить запрос больше не через кого: иначе успех обнулил бы
+		// счетчик ошибок автомата защиты
+		if ps.shouldRetry(resp, nil) {
+			ps.proxyManager.IncrementProxyErrorCount(proxy.URL, attemptFailure(resp, err))
+		} else {
+			ps.proxyManager.RecordProxySuccess(proxy.URL, requestDuration)
+		}
+		return upstreamResult{proxy: proxy, resp: resp, duration: requestDuration}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Selector выбирает прокси из снимка пула. eligible сообщает, можно ли
+// сейчас выдать прокси с данным индексом. Select возвращает индекс
+// выбранного прокси или -1, если подходящих нет.
+type Selector interface {
+	Name() string
+	Select(pool *proxyPool, eligible func(i int) bool) int
+}
+
+// Названия встроенных стратегий выбора
+const (
+	SelectorLRU              = "lru"
+	SelectorRoundRobin       = "round-robin"
+	SelectorRandom           = "random"
+	SelectorWeighted         = "weighted"
+	SelectorLeastConnections = "least-connections"
+	SelectorLowestLatency    = "lowest-latency"
+	SelectorPowerOfTwo       = "p2c"
+)
+
+// newSelector создает стратегию выбора по названию из конфигурации
+func newSelector(name string) (Selector, error) {
+	switch name {
+	case SelectorLRU:
+		return &lruSelector{}, nil
+	case SelectorRoundRobin:
+		return &roundRobinSelector{}, nil
+	case SelectorRandom:
+		return &randomSelector{}, nil
+	case SelectorWeighted:
+		return &weightedSelector{}, nil
+	case SelectorLeastConnections:
+		return &leastConnectionsSelector{}, nil
+	case SelectorLowestLatency:
+		return &lowestLatencySelector{}, nil
+	case SelectorPowerOfTwo:
+		return &powerOfTwoSelector{}, nil
+	default:
+		return nil, fmt.Errorf("неизвестная стратегия выбора прокси: %s", name)
+	}
+}
+
+// lruSelector выбирает прокси, который не использовался дольше всего
+type lruSelector struct{}
+
+func (s *lruSelector) Name() string { return SelectorLRU }
+
+func (s *lruSelector) Select(pool *proxyPool, eligible func(i int) bool) int {
+	selected := -1
+	var oldest int64 = math.MaxInt64
+	for i, p := range pool.proxies {
+		if !eligible(i) {
+			continue
+		}
+		if lastUsed := atomic.LoadInt64(&p.lastUsed); lastUsed < oldest {
+			oldest = lastUsed
+			selected = i
+		}
+	}
+	return selected
+}
+
+// roundRobinSelector перебирает прокси по кругу
+type roundRobinSelector struct {
+	next uint64 // Позиция следующего прокси
+}
+
+func (s *roundRobinSelector) Name() string { return SelectorRoundRobin }
+
+func (s *roundRobinSelector) Select(pool *proxyPool, eligible func(i int) bool) int {
+	n := len(pool.proxies)
+	start := int((atomic.AddUint64(&s.next, 1) - 1) % uint64(n))
+	return scanFrom(n, start, eligible)
+}
+
+// randomSelector выбирает случайный прокси с равной вероятностью
+type randomSelector struct{}
+
+func (s *randomSelector) Name() string { return SelectorRandom }
+
+func (s *randomSelector) Select(pool *proxyPool, eligible func(i int) bool) int {
+	n := len(pool.proxies)
+	for attempt := 0; attempt < maxSampleAttempts; attempt++ {
+		if i := rand.Intn(n); eligible(i) {
+			return i
+		}
+	}
+	return scanFrom(n, rand.Intn(n), eligible)
+}
+
+// weightedSelector выбирает прокси пропорционально весу методом псевдонимов
+type weightedSelector struct{}
+
+func (s *weightedSelector) Name() string { return SelectorWeighted }
+
+// Select выполняет выборку из таблицы псевдонимов за O(1); полный перебор
+// выполняется только если большая часть пула недоступна
+func (s *weightedSelector) Select(pool *proxyPool, eligible func(i int) bool) int {
+	for attempt := 0; attempt < maxSampleAttempts; attempt++ {
+		if i := pool.alias.Sample(); eligible(i) {
+			return i
+		}
+	}
+
+	var totalWeight float64
+	for i := range pool.proxies {
+		if eligible(i) {
+			totalWeight += pool.weights[i]
+		}
+	}
+
+	selected := -1
+	target := rand.Float64() * totalWeight
+	for i := range pool.proxies {
+		if !eligible(i) {
+			continue
+		}
+		selected = i
+		target -= pool.weights[i]
+		if target < 0 {
+			break
+		}
+	}
+	return selected
+}
+
+// leastConnectionsSelector выбирает прокси с наименьшим числом активных запросов
+type leastConnectionsSelector struct{}
+
+func (s *leastConnectionsSelector) Name() string { return SelectorLeastConnections }
+
+func (s *leastConnectionsSelector) Select(pool *proxyPool, eligible func(i int) bool) int {
+	return selectMin(pool, eligible, func(p *Proxy) float64 {
+		return float64(atomic.LoadInt64(&p.ActiveConns))
+	})
+}
+
+// lowestLatencySelector выбирает прокси с наименьшей EWMA задержкой.
+// Прокси без замеров имеют нулевую задержку и выбираются первыми.
+type lowestLatencySelector struct{}
+
+func (s *lowestLatencySelector) Name() string { return SelectorLowestLatency }
+
+func (s *lowestLatencySelector) Select(pool *proxyPool, eligible func(i int) bool) int {
+	return selectMin(pool, eligible, func(p *Proxy) float64 {
+		return p.LatencyEWMA()
+	})
+}
+
+// powerOfTwoSelector сравнивает два случайных прокси и берет менее нагруженный
+type powerOfTwoSelector struct{}
+
+func (s *powerOfTwoSelector) Name() string { return SelectorPowerOfTwo }
+
+func (s *powerOfTwoSelector) Select(pool *proxyPool, eligible func(i int) bool) int {
+	n := len(pool.proxies)
+	first, second := -1, -1
+	for attempt := 0; attempt < maxSampleAttempts && second < 0; attempt++ {
+		i := rand.Intn(n)
+		if i == first || !eligible(i) {
+			continue
+		}
+		if first < 0 {
+			first = i
+		} else {
+			second = i
+		}
+	}
+
+	if first < 0 {
+		return scanFrom(n, rand.Intn(n), eligible)
+	}
+	if second < 0 {
+		return first
+	}
+
+	a, b := pool.proxies[first], pool.proxies[second]
+	connsA, connsB := atomic.LoadInt64(&a.ActiveConns), atomic.LoadInt64(&b.ActiveConns)
+	if connsA != connsB {
+		if connsA < connsB {
+			return first
+		}
+		return second
+	}
+	if b.LatencyEWMA() < a.LatencyEWMA() {
+		return second
+	}
+	return first
+}
+
+// scanFrom возвращает первый подходящий индекс, начиная со start по кругу
+func scanFrom(n, start int, eligible func(i int) bool) int {
+	for j := 0; j < n; j++ {
+		if i := (start + j) % n; eligible(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+// selectMin возвращает подходящий прокси с минимальной оценкой.
+// Перебор начинается со случайной позиции, чтобы равные оценки не
+// приводили к выбору одного и того же прокси.
+func selectMin(pool *proxyPool, eligible func(i int) bool, score func(p *Proxy) float64) int {
+	n := len(pool.proxies)
+	start := rand.Intn(n)
+	selected := -1
+	best := math.Inf(1)
+	for j := 0; j < n; j++ {
+		i := (start + j) % n
+		if !eligible(i) {
+			continue
+		}
+		if v := score(pool.proxies[i]); selected < 0 || v < best {
+			best = v
+			selected = i
+		}
+	}
+	return selected
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestPool строит снимок пула из прокси с весами weights
+func newTestPool(weights ...float64) *proxyPool {
+	proxies := make([]*Proxy, len(weights))
+	for i, w := range weights {
+		proxies[i] = &Proxy{Host: "10.0.0.1", Port: 1080 + i, Weight: w}
+	}
+	return newProxyPool(proxies)
+}
+
+// allEligible разрешает выбор любого прокси
+func allEligible(i int) bool { return true }
+
+// onlyEligible разрешает выбор только перечисленных индексов
+func onlyEligible(indexes ...int) func(i int) bool {
+	allowed := make(map[int]bool, len(indexes))
+	for _, i := range indexes {
+		allowed[i] = true
+	}
+	return func(i int) bool { return allowed[i] }
+}
+
+// setLatency записывает EWMA задержки прокси в миллисекундах
+func setLatency(p *Proxy, ms float64) {
+	atomic.StoreUint64(&p.latencyBits, math.Float64bits(ms))
+}
+
+func TestNewSelector(t *testing.T) {
+	for _, name := range []string{
+		SelectorLRU, SelectorRoundRobin, SelectorRandom, SelectorWeighted,
+		SelectorLeastConnections, SelectorLowestLatency, SelectorPowerOfTwo,
+	} {
+		s, err := newSelector(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if s.Name() != name {
+			t.Fatalf("стратегия %s называется %s", name, s.Name())
+		}
+		// Когда подходящих прокси нет, любая стратегия возвращает -1
+		if i := s.Select(newTestPool(1, 1, 1), onlyEligible()); i != -1 {
+			t.Fatalf("%s: выбран %d без подходящих прокси", name, i)
+		}
+		for j := 0; j < 100; j++ {
+			if i := s.Select(newTestPool(1, 1, 1, 1), onlyEligible(2)); i != 2 {
+				t.Fatalf("%s: выбран неподходящий прокси %d", name, i)
+			}
+		}
+	}
+
+	if _, err := newSelector("fastest"); err == nil {
+		t.Fatal("неизвестная стратегия принята")
+	}
+}
+
+func TestLRUSelector(t *testing.T) {
+	pool := newTestPool(1, 1, 1, 1)
+	now := time.Now()
+	for i, ago := range []time.Duration{time.Second, time.Minute, time.Hour, 0} {
+		atomic.StoreInt64(&pool.proxies[i].lastUsed, now.Add(-ago).UnixNano())
+	}
+	s := &lruSelector{}
+	if i := s.Select(pool, allEligible); i != 2 {
+		t.Fatalf("выбран %d вместо давно не использованного 2", i)
+	}
+	if i := s.Select(pool, onlyEligible(0, 1, 3)); i != 1 {
+		t.Fatalf("выбран %d вместо 1", i)
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	pool := newTestPool(1, 1, 1, 1)
+	s := &roundRobinSelector{}
+	for round := 0; round < 2; round++ {
+		for want := 0; want < 4; want++ {
+			if i := s.Select(pool, allEligible); i != want {
+				t.Fatalf("круг %d: выбран %d вместо %d", round, i, want)
+			}
+		}
+	}
+
+	// Неподходящие прокси пропускаются, следующий поиск идет со следующей позиции
+	s = &roundRobinSelector{}
+	eligible := onlyEligible(1, 3)
+	for _, want := range []int{1, 1, 3, 3, 1} {
+		if i := s.Select(pool, eligible); i != want {
+			t.Fatalf("выбран %d вместо %d", i, want)
+		}
+	}
+}
+
+func TestRandomSelector(t *testing.T) {
+	pool := newTestPool(1, 100, 1, 1)
+	s := &randomSelector{}
+	counts := make([]int, 4)
+	for j := 0; j < 40000; j++ {
+		counts[s.Select(pool, onlyEligible(0, 1, 2))]++
+	}
+	if counts[3] != 0 {
+		t.Fatalf("выбран неподходящий прокси: %v", counts)
+	}
+	// Веса не учитываются
+	for i := 0; i < 3; i++ {
+		if share := float64(counts[i]) / 40000; math.Abs(share-1.0/3) > 0.02 {
+			t.Fatalf("доля %d = %.4f, ожидалась 1/3: %v", i, share, counts)
+		}
+	}
+}
+
+func TestWeightedSelector(t *testing.T) {
+	weights := []float64{1, 2, 3, 4}
+	pool := newTestPool(weights...)
+	s := &weightedSelector{}
+
+	share := func(eligible func(i int) bool, samples int) []float64 {
+		counts := make([]float64, len(weights))
+		for j := 0; j < samples; j++ {
+			counts[s.Select(pool, eligible)]++
+		}
+		for i := range counts {
+			counts[i] /= float64(samples)
+		}
+		return counts
+	}
+
+	shares := share(allEligible, 100000)
+	for i, w := range weights {
+		if math.Abs(shares[i]-w/10) > 0.01 {
+			t.Errorf("доля %d = %.4f, ожидалось %.2f", i, shares[i], w/10)
+		}
+	}
+
+	// Среди подходящих прокси пропорции сохраняются
+	shares = share(onlyEligible(0, 3), 50000)
+	if shares[1] != 0 || shares[2] != 0 || math.Abs(shares[0]-0.2) > 0.01 || math.Abs(shares[3]-0.8) > 0.01 {
+		t.Errorf("доли при подходящих 0 и 3: %v", shares)
+	}
+
+	// Полный перебор после неудачных выборок тоже учитывает вес
+	weights = make([]float64, 1000)
+	for i := range weights {
+		weights[i] = 1
+	}
+	weights[999] = 3
+	pool = newTestPool(weights...)
+	counts := make([]int, len(weights))
+	for j := 0; j < 20000; j++ {
+		counts[s.Select(pool, onlyEligible(998, 999))]++
+	}
+	if got := float64(counts[999]) / 20000; math.Abs(got-0.75) > 0.02 {
+		t.Errorf("доля 999 при переборе = %.4f, ожидалось 0.75", got)
+	}
+}
+
+func TestLeastConnectionsSelector(t *testing.T) {
+	pool := newTestPool(1, 1, 1, 1)
+	for i, conns := range []int64{3, 1, 5, 1} {
+		atomic.StoreInt64(&pool.proxies[i].ActiveConns, conns)
+	}
+	s := &leastConnectionsSelector{}
+	seen := make(map[int]bool)
+	for j := 0; j < 200; j++ {
+		i := s.Select(pool, allEligible)
+		if i != 1 && i != 3 {
+			t.Fatalf("выбран %d с %d соединениями", i, pool.proxies[i].ActiveConns)
+		}
+		seen[i] = true
+	}
+	// Равные оценки не приводят к выбору одного и того же прокси
+	if len(seen) != 2 {
+		t.Fatalf("при равной нагрузке выбирался только %v", seen)
+	}
+	if i := s.Select(pool, onlyEligible(0, 2)); i != 0 {
+		t.Fatalf("выбран %d вместо 0", i)
+	}
+}
+
+func TestLowestLatencySelector(t *testing.T) {
+	pool := newTestPool(1, 1, 1)
+	setLatency(pool.proxies[0], 120)
+	setLatency(pool.proxies[1], 40)
+	setLatency(pool.proxies[2], 80)
+	s := &lowestLatencySelector{}
+	if i := s.Select(pool, allEligible); i != 1 {
+		t.Fatalf("выбран %d вместо самого быстрого 1", i)
+	}
+	if i := s.Select(pool, onlyEligible(0, 2)); i != 2 {
+		t.Fatalf("выбран %d вместо 2", i)
+	}
+
+	// Прокси без замеров выбирается первым
+	pool.proxies = append(pool.proxies, &Proxy{Host: "10.0.0.2", Port: 1080})
+	if i := s.Select(pool, allEligible); i != 3 {
+		t.Fatalf("выбран %d вместо прокси без замеров", i)
+	}
+}
+
+func TestPowerOfTwoSelector(t *testing.T) {
+	pool := newTestPool(1, 1)
+	atomic.StoreInt64(&pool.proxies[0].ActiveConns, 2)
+	s := &powerOfTwoSelector{}
+	for j := 0; j < 100; j++ {
+		if i := s.Select(pool, allEligible); i != 1 {
+			t.Fatalf("выбран %d вместо менее нагруженного 1", i)
+		}
+	}
+
+	// При равной нагрузке решает задержка
+	atomic.StoreInt64(&pool.proxies[0].ActiveConns, 0)
+	setLatency(pool.proxies[0], 10)
+	setLatency(pool.proxies[1], 50)
+	for j := 0; j < 100; j++ {
+		if i := s.Select(pool, allEligible); i != 0 {
+			t.Fatalf("выбран %d вместо быстрого 0", i)
+		}
+	}
+
+	// Самый нагруженный прокси из трех никогда не выигрывает сравнение
+	pool = newTestPool(1, 1, 1)
+	for i, conns := range []int64{0, 1, 9} {
+		atomic.StoreInt64(&pool.proxies[i].ActiveConns, conns)
+	}
+	for j := 0; j < 300; j++ {
+		if i := s.Select(pool, allEligible); i == 2 {
+			t.Fatal("выбран самый нагруженный прокси")
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tunnelPollInterval — период проверки завершения туннелей при остановке
+const tunnelPollInterval = 100 * time.Millisecond
+
+// tunnelConns — соединения CONNECT-туннеля, закрываемые при остановке,
+// если туннель не завершился сам
+type tunnelConns struct {
+	client   net.Conn
+	upstream net.Conn
+}
+
+// tunnelTracker учитывает CONNECT-запросы и открытые туннели. Перехваченные
+// соединения не отслеживаются http.Server, поэтому ожидаются отдельно.
+// Запрос учитывается с начала обработки, чтобы остановка не завершилась,
+// пока туннель еще устанавливается через прокси.
+type tunnelTracker struct {
+	mu      sync.Mutex
+	pending int  // Обрабатываемые CONNECT-запросы, включая открытые туннели
+	closed  bool // Туннели закрыты при остановке, новые сразу закрываются
+	tunnels map[*tunnelConns]struct{}
+}
+
+// begin учитывает CONNECT-запрос и возвращает функцию, вызываемую по
+// завершении его обработки
+func (t *tunnelTracker) begin() func() {
+	t.mu.Lock()
+	t.pending++
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		t.pending--
+		t.mu.Unlock()
+	}
+}
+
+// track регистрирует туннель и возвращает функцию для снятия его с учета.
+// После closeAll соединения туннеля сразу закрываются.
+func (t *tunnelTracker) track(client, upstream net.Conn) func() {
+	tunnel := &tunnelConns{client: client, upstream: upstream}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		client.Close()
+		upstream.Close()
+		return func() {}
+	}
+	if t.tunnels == nil {
+		t.tunnels = make(map[*tunnelConns]struct{})
+	}
+	t.tunnels[tunnel] = struct{}{}
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.tunnels, tunnel)
+		t.mu.Unlock()
+	}
+}
+
+// idle сообщает, что нет ни обрабатываемых CONNECT-запросов, ни открытых туннелей
+func (t *tunnelTracker) idle() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pending == 0 && len(t.tunnels) == 0
+}
+
+// wait ждет завершения всех CONNECT-запросов и туннелей.
+// Возвращает false, если ctx завершился раньше.
+func (t *tunnelTracker) wait(ctx context.Context) bool {
+	ticker := time.NewTicker(tunnelPollInterval)
+	defer ticker.Stop()
+	for !t.idle() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// closeAll принудительно закрывает оставшиеся туннели, запрещает открытие
+// новых и возвращает количество прерванных CONNECT-запросов
+func (t *tunnelTracker) closeAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for tunnel := range t.tunnels {
+		tunnel.client.Close()
+		tunnel.upstream.Close()
+	}
+	if t.pending > len(t.tunnels) {
+		return t.pending
+	}
+	return len(t.tunnels)
+}
+
+// Shutdown плавно останавливает сервер: прекращает прием соединений,
+// дожидается обработки запросов из очереди, дает CONNECT-туннелям
+// завершиться до tunnel_drain_timeout (но не позже ctx), затем закрывает
+// оставшиеся туннели и транспорты прокси, сохраняет статистику прокси,
+// закрывает сервер метрик и журнал запросов.
+// Возвращает ошибку, если остановка прошла не чисто.
+func (ps *ProxyServer) Shutdown(ctx context.Context) error {
+	var problems []string
+
+	// Туннели дренируются параллельно с ожиданием HTTP-запросов
+	tunnelCtx, cancelTunnels := context.WithTimeout(ctx, time.Duration(ps.config.TunnelDrainTimeout)*time.Second)
+	defer cancelTunnels()
+	tunnelsDone := make(chan bool, 1)
+	go func() {
+		tunnelsDone <- ps.tunnels.wait(tunnelCtx)
+	}()
+
+	if ps.server != nil {
+		if err := ps.server.Shutdown(ctx); err != nil {
+			problems = append(problems, fmt.Sprintf("не все HTTP-запросы завершены: %v", err))
+			ps.server.Close()
+		}
+	}
+
+	if !<-tunnelsDone {
+		if n := ps.tunnels.closeAll(); n > 0 {
+			problems = append(problems, fmt.Sprintf("принудительно закрыто туннелей: %d", n))
+		}
+	}
+
+	// Новых задач больше не будет: останавливаем воркеров. Если запросы
+	// не дождались завершения, очередь не закрываем — воркеры еще пишут в нее.
+	if ps.requestQueue != nil && len(problems) == 0 {
+		close(ps.requestQueue)
+	}
+
+	ps.transportPool.Range(func(key, value interface{}) bool {
+		value.(*http.Transport).CloseIdleConnections()
+		ps.transportPool.Delete(key)
+		return true
+	})
+
+	if err := ps.proxyManager.SaveState(); err != nil {
+		problems = append(problems, fmt.Sprintf("состояние прокси: %v", err))
+	}
+
+	if err := ps.metrics.Shutdown(ctx); err != nil {
+		problems = append(problems, fmt.Sprintf("сервер метрик: %v", err))
+	}
+
+	if ps.accessLog != nil {
+		if err := ps.accessLog.Close(); err != nil {
+			problems = append(problems, fmt.Sprintf("журнал запросов: %v", err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("остановка с потерями: %s", strings.Join(problems, "; "))
+	}
+	log.Printf("Сервер остановлен, все запросы и туннели завершены")
+	return nil
+}
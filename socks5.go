@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Константы протокола SOCKS5 (RFC 1928, RFC 1929)
+const (
+	socks5Version        = 0x05
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5AuthNoMethods  = 0xFF
+	socks5PasswordVer    = 0x01
+	socks5CmdConnect     = 0x01
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+	socks5ReplySucceeded = 0x00
+)
+
+// socks5ReplyErrors описывает коды ошибок ответа SOCKS5
+var socks5ReplyErrors = map[byte]string{
+	0x01: "общий сбой SOCKS-сервера",
+	0x02: "соединение запрещено правилами",
+	0x03: "сеть недоступна",
+	0x04: "хост недоступен",
+	0x05: "в соединении отказано",
+	0x06: "истек TTL",
+	0x07: "команда не поддерживается",
+	0x08: "тип адреса не поддерживается",
+}
+
+// socks5Dialer устанавливает соединения через SOCKS5-прокси
+type socks5Dialer struct {
+	proxyAddr string // Адрес прокси host:port
+	username  string // Имя пользователя (пустое — без авторизации)
+	password  string // Пароль
+	remoteDNS bool   // Передавать прокси имя хоста вместо IP-адреса (socks5h)
+}
+
+// newSOCKS5Dialer создает SOCKS5-клиент по URL прокси
+func newSOCKS5Dialer(proxyURL *url.URL) *socks5Dialer {
+	d := &socks5Dialer{
+		proxyAddr: proxyURL.Host,
+		remoteDNS: proxyURL.Scheme == SchemeSOCKS5H,
+	}
+	if proxyURL.User != nil {
+		d.username = proxyURL.User.Username()
+		d.password, _ = proxyURL.User.Password()
+	}
+	return d
+}
+
+// DialContext открывает соединение с addr через прокси.
+// Сигнатура совместима с http.Transport.DialContext.
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("SOCKS5: сеть %s не поддерживается", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5: некорректный адрес %q: %v", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("SOCKS5: некорректный порт %q", portStr)
+	}
+
+	// Для socks5 имя разрешается локально, для socks5h — на стороне прокси
+	ip := net.ParseIP(host)
+	if ip == nil && !d.remoteDNS {
+		ip, err = resolveHost(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("SOCKS5: ошибка разрешения %s: %v", host, err)
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка соединения с прокси: %v", err)
+	}
+	tuneConn(conn)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := d.handshake(conn, host, ip, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// handshake выполняет согласование авторизации и команду CONNECT
+func (d *socks5Dialer) handshake(conn net.Conn, host string, ip net.IP, port int) error {
+	// Приветствие со списком поддерживаемых методов авторизации
+	methods := []byte{socks5AuthNone}
+	if d.username != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("SOCKS5: ошибка отправки приветствия: %v", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("SOCKS5: ошибка чтения ответа на приветствие: %v", err)
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("SOCKS5: неожиданная версия протокола %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5AuthNoMethods:
+		return errors.New("SOCKS5: прокси не принял ни один метод авторизации")
+	default:
+		return fmt.Errorf("SOCKS5: прокси выбрал неподдерживаемый метод авторизации %d", reply[1])
+	}
+
+	// Запрос CONNECT
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	switch {
+	case ip != nil && ip.To4() != nil:
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip.To4()...)
+	case ip != nil:
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return fmt.Errorf("SOCKS5: слишком длинное имя хоста %q", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	req = append(req, portBytes...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("SOCKS5: ошибка отправки CONNECT: %v", err)
+	}
+
+	// Ответ: VER REP RSV ATYP BND.ADDR BND.PORT
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("SOCKS5: ошибка чтения ответа на CONNECT: %v", err)
+	}
+	if header[1] != socks5ReplySucceeded {
+		msg, ok := socks5ReplyErrors[header[1]]
+		if !ok {
+			msg = fmt.Sprintf("код %d", header[1])
+		}
+		return fmt.Errorf("SOCKS5: прокси отклонил CONNECT: %s", msg)
+	}
+
+	var addrLen int
+	switch header[3] {
+	case socks5AddrIPv4:
+		addrLen = net.IPv4len
+	case socks5AddrIPv6:
+		addrLen = net.IPv6len
+	case socks5AddrDomain:
+		lenByte := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenByte); err != nil {
+			return fmt.Errorf("SOCKS5: ошибка чтения ответа на CONNECT: %v", err)
+		}
+		addrLen = int(lenByte[0])
+	default:
+		return fmt.Errorf("SOCKS5: неизвестный тип адреса %d в ответе", header[3])
+	}
+
+	// Адрес и порт привязки не нужны, но должны быть вычитаны из потока
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		return fmt.Errorf("SOCKS5: ошибка чтения ответа на CONNECT: %v", err)
+	}
+
+	return nil
+}
+
+// authenticate выполняет авторизацию по имени и паролю (RFC 1929)
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	if len(d.username) > 255 || len(d.password) > 255 {
+		return errors.New("SOCKS5: имя пользователя или пароль длиннее 255 байт")
+	}
+
+	req := []byte{socks5PasswordVer, byte(len(d.username))}
+	req = append(req, d.username...)
+	req = append(req, byte(len(d.password)))
+	req = append(req, d.password...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("SOCKS5: ошибка отправки авторизации: %v", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("SOCKS5: ошибка чтения ответа авторизации: %v", err)
+	}
+	if reply[1] != 0x00 {
+		return errors.New("SOCKS5: неверное имя пользователя или пароль")
+	}
+	return nil
+}
+
+// resolveHost разрешает имя хоста, предпочитая IPv4-адреса
+func resolveHost(ctx context.Context, host string) (net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP, nil
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("адреса не найдены")
+	}
+	return addrs[0].IP, nil
+}
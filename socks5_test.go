@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// socks5Credentials — логин и пароль, полученные тестовым SOCKS5-сервером
+type socks5Credentials struct {
+	user, pass string
+	ok         bool // Клиент выполнил авторизацию по паролю
+}
+
+// newTestSOCKS5Server запускает SOCKS5-сервер, который принимает одно
+// соединение: выбирает авторизацию по паролю, если клиент ее предлагает,
+// отвечает успехом на CONNECT и передает полученные учетные данные в канал
+func newTestSOCKS5Server(t *testing.T) (string, <-chan socks5Credentials) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	result := make(chan socks5Credentials, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		var creds socks5Credentials
+		defer func() { result <- creds }()
+
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		methods := make([]byte, header[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		method := byte(socks5AuthNone)
+		for _, m := range methods {
+			if m == socks5AuthPassword {
+				method = socks5AuthPassword
+			}
+		}
+		conn.Write([]byte{socks5Version, method})
+
+		if method == socks5AuthPassword {
+			readField := func() string {
+				size := make([]byte, 1)
+				io.ReadFull(conn, size)
+				field := make([]byte, size[0])
+				io.ReadFull(conn, field)
+				return string(field)
+			}
+			version := make([]byte, 1)
+			io.ReadFull(conn, version)
+			creds.user, creds.pass, creds.ok = readField(), readField(), true
+			conn.Write([]byte{socks5PasswordVer, 0x00})
+		}
+
+		// CONNECT с адресом-доменом: VER CMD RSV ATYP LEN HOST PORT
+		request := make([]byte, 5)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		io.ReadFull(conn, make([]byte, int(request[4])+2))
+		conn.Write([]byte{socks5Version, socks5ReplySucceeded, 0x00, socks5AddrIPv4, 127, 0, 0, 1, 0, 80})
+	}()
+	return listener.Addr().String(), result
+}
+
+func TestSOCKS5Authentication(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		user string
+		pass string
+		auth bool
+	}{
+		{"логин и пароль", "user", "secret", true},
+		{"пустой пароль", "user", "", true},
+		{"без авторизации", "", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, result := newTestSOCKS5Server(t)
+			host, port := hostPort(t, addr)
+			proxy, err := newProxyFromJSON(ProxyJSON{Host: host, Port: port, User: tc.user, Pass: tc.pass, Scheme: SchemeSOCKS5H}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := newSOCKS5Dialer(proxy.parsedURL).DialContext(ctx, "tcp", "example.com:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+
+			creds := <-result
+			if creds.ok != tc.auth || creds.user != tc.user || creds.pass != tc.pass {
+				t.Fatalf("сервер получил %+v, ожидалось %q/%q, авторизация %v", creds, tc.user, tc.pass, tc.auth)
+			}
+		})
+	}
+}
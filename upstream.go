@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Схемы подключения к вышестоящему прокси
+const (
+	SchemeHTTP    = "http"    // HTTP-прокси, туннель через CONNECT
+	SchemeHTTPS   = "https"   // HTTP-прокси поверх TLS
+	SchemeSOCKS5  = "socks5"  // SOCKS5, имя хоста разрешается локально
+	SchemeSOCKS5H = "socks5h" // SOCKS5, имя хоста разрешается на стороне прокси
+)
+
+// isSOCKSScheme сообщает, является ли схема вариантом SOCKS5
+func isSOCKSScheme(scheme string) bool {
+	return scheme == SchemeSOCKS5 || scheme == SchemeSOCKS5H
+}
+
+// dialViaProxy открывает соединение с прокси и устанавливает через него
+// туннель до target (host:port) в соответствии со схемой прокси
+func dialViaProxy(p *Proxy, target string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return dialViaProxyContext(ctx, p, target)
+}
+
+// dialViaProxyContext — вариант dialViaProxy с контекстом вместо таймаута
+func dialViaProxyContext(ctx context.Context, p *Proxy, target string) (net.Conn, error) {
+	if isSOCKSScheme(p.Scheme) {
+		return newSOCKS5Dialer(p.parsedURL).DialContext(ctx, "tcp", target)
+	}
+	return dialHTTPConnect(ctx, p, target)
+}
+
+// configureUpstream настраивает транспорт на работу через прокси.
+// HTTP-прокси передается транспорту штатно, для SOCKS5 подменяется DialContext,
+// а для https-прокси транспорт работает с ним как с HTTP-прокси поверх
+// собственного TLS-соединения, чтобы настройки TLS прокси не смешивались
+// с настройками TLS целевого сервера.
+func configureUpstream(transport *http.Transport, p *Proxy) {
+	switch {
+	case isSOCKSScheme(p.Scheme):
+		transport.Proxy = nil
+		transport.DialContext = newSOCKS5Dialer(p.parsedURL).DialContext
+	case p.Scheme == SchemeHTTPS:
+		plainURL := *p.parsedURL
+		plainURL.Scheme = SchemeHTTP
+		transport.Proxy = http.ProxyURL(&plainURL)
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialProxyConn(ctx, p)
+		}
+	default:
+		transport.Proxy = http.ProxyURL(p.parsedURL)
+	}
+}
+
+// dialProxyConn открывает соединение с самим прокси, для https-прокси — с TLS
+func dialProxyConn(ctx context.Context, p *Proxy) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.parsedURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка соединения с прокси: %v", err)
+	}
+	tuneConn(conn)
+
+	if p.Scheme != SchemeHTTPS {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, p.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ошибка TLS-соединения с прокси: %v", err)
+	}
+	return tlsConn, nil
+}
+
+// dialHTTPConnect устанавливает туннель через HTTP-прокси методом CONNECT
+func dialHTTPConnect(ctx context.Context, p *Proxy, target string) (net.Conn, error) {
+	proxyConn, err := dialProxyConn(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := ""
+	if p.parsedURL.User != nil {
+		username := p.parsedURL.User.Username()
+		password, _ := p.parsedURL.User.Password()
+		auth = fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", basicAuth(username, password))
+	}
+
+	connectReq := fmt.Sprintf(
+		"CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n",
+		target, target, auth,
+	)
+	if deadline, ok := ctx.Deadline(); ok {
+		proxyConn.SetDeadline(deadline)
+	}
+	if _, err := fmt.Fprint(proxyConn, connectReq); err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("ошибка отправки CONNECT: %v", err)
+	}
+
+	buffer := make([]byte, 1024)
+	n, err := proxyConn.Read(buffer)
+	if err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("ошибка чтения ответа от прокси: %v", err)
+	}
+
+	// Ожидаем строку статуса вида "HTTP/1.1 200 ..."
+	statusLine := strings.SplitN(string(buffer[:n]), "\r\n", 2)[0]
+	fields := strings.Fields(statusLine)
+	if len(fields) < 2 || fields[1] != "200" {
+		proxyConn.Close()
+		return nil, fmt.Errorf("прокси отклонил CONNECT: %s", statusLine)
+	}
+
+	// Снимаем дедлайн, дальше соединение используется без ограничений
+	proxyConn.SetDeadline(time.Time{})
+	return proxyConn, nil
+}
+
+// proxyTLSLoader строит TLS-настройки https-прокси, кэшируя прочитанные
+// CA-бандлы и клиентские сертификаты на время загрузки списка
+type proxyTLSLoader struct {
+	defaultCAFile string
+	pools         map[string]*x509.CertPool
+	certs         map[string]tls.Certificate
+}
+
+// newProxyTLSLoader создает загрузчик с CA-бандлом по умолчанию
+func newProxyTLSLoader(defaultCAFile string) *proxyTLSLoader {
+	return &proxyTLSLoader{
+		defaultCAFile: defaultCAFile,
+		pools:         make(map[string]*x509.CertPool),
+		certs:         make(map[string]tls.Certificate),
+	}
+}
+
+// build возвращает TLS-настройки для соединения с прокси
+func (l *proxyTLSLoader) build(p *Proxy) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: p.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = p.Host
+	}
+
+	caFile := p.CAFile
+	if caFile == "" {
+		caFile = l.defaultCAFile
+	}
+	if caFile != "" {
+		pool, ok := l.pools[caFile]
+		if !ok {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("ошибка чтения CA-бандла: %v", err)
+			}
+			pool = x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("в файле %s не найдено сертификатов", caFile)
+			}
+			l.pools[caFile] = pool
+		}
+		cfg.RootCAs = pool
+	}
+
+	if p.CertFile != "" || p.KeyFile != "" {
+		if p.CertFile == "" || p.KeyFile == "" {
+			return nil, fmt.Errorf("для клиентского сертификата нужны cert_file и key_file")
+		}
+		key := p.CertFile + "\x00" + p.KeyFile
+		cert, ok := l.certs[key]
+		if !ok {
+			var err error
+			cert, err = tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("ошибка загрузки клиентского сертификата: %v", err)
+			}
+			l.certs[key] = cert
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// tuneConn устанавливает размеры буферов для TCP соединения
+func tuneConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetReadBuffer(256 * 1024)  // 256KB
+		tcpConn.SetWriteBuffer(256 * 1024) // 256KB
+	}
+}
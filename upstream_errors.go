@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamClass — классификация ответа вышестоящего сервера
+type upstreamClass int
+
+const (
+	UpstreamOK          upstreamClass = iota // Успешный ответ (1xx-3xx без ошибки JSON-RPC)
+	UpstreamError                            // Ответ 4xx/5xx или ошибка JSON-RPC
+	UpstreamRateLimited                      // 429 или ошибка JSON-RPC об ограничении частоты
+)
+
+// Ограничения на разбор тела ответа при классификации
+const (
+	classifyPeekSize   = 4096                  // Сколько байт тела читается для поиска ошибки JSON-RPC
+	classifyMaxBody    = 64 * 1024             // Ответы большего размера не разбираются
+	maxRetryAfterDelay = 5 * time.Minute       // Предел охлаждения по Retry-After
+	minRetryAfterDelay = 10 * time.Millisecond // Минимальное охлаждение, чтобы прокси не выдавался сразу снова
+)
+
+// classifiedBody — тело ответа с результатом классификации. Прочитанное
+// при классификации начало тела возвращается в поток.
+type classifiedBody struct {
+	io.Reader
+	io.Closer
+	class upstreamClass
+}
+
+// responseClass возвращает класс ответа, определенный в doUpstream
+func responseClass(resp *http.Response) upstreamClass {
+	if body, ok := resp.Body.(*classifiedBody); ok {
+		return body.class
+	}
+	return UpstreamOK
+}
+
+// classifyResponse определяет класс ответа по статусу и, для небольших
+// JSON-ответов, по ошибке JSON-RPC в теле
+func (ps *ProxyServer) classifyResponse(resp *http.Response) upstreamClass {
+	class := UpstreamOK
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		class = UpstreamRateLimited
+	case resp.StatusCode >= 400:
+		class = UpstreamError
+	}
+
+	if resp.ContentLength > classifyMaxBody || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		resp.Body = &classifiedBody{Reader: resp.Body, Closer: resp.Body, class: class}
+		return class
+	}
+
+	prefix := make([]byte, classifyPeekSize)
+	n, _ := io.ReadFull(resp.Body, prefix)
+	prefix = prefix[:n]
+	resp.Body = &classifiedBody{
+		Reader: io.MultiReader(bytes.NewReader(prefix), resp.Body),
+		Closer: resp.Body,
+	}
+
+	if rpcClass, ok := ps.classifyRPCError(prefix); ok && rpcClass > class {
+		class = rpcClass
+	}
+	resp.Body.(*classifiedBody).class = class
+	return class
+}
+
+// rpcErrorBody — ответ JSON-RPC с ошибкой
+type rpcErrorBody struct {
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// classifyRPCError ищет в теле ответа ошибку JSON-RPC. Ошибка считается
+// ограничением частоты, если ее код указан в rate_limit_error_codes или
+// сообщение упоминает rate limit.
+func (ps *ProxyServer) classifyRPCError(data []byte) (upstreamClass, bool) {
+	var body rpcErrorBody
+	if err := json.Unmarshal(data, &body); err != nil || body.Error == nil {
+		return UpstreamOK, false
+	}
+
+	for _, code := range ps.config.RateLimitErrorCodes {
+		if body.Error.Code == code {
+			return UpstreamRateLimited, true
+		}
+	}
+	message := strings.ToLower(body.Error.Message)
+	if strings.Contains(message, "rate limit") || strings.Contains(message, "too many requests") {
+		return UpstreamRateLimited, true
+	}
+	return UpstreamError, true
+}
+
+// retryAfter возвращает задержку из заголовка Retry-After (секунды или
+// HTTP-дата), а при его отсутствии — rate_limit_cooldown_ms
+func (ps *ProxyServer) retryAfter(resp *http.Response) time.Duration {
+	delay := time.Duration(ps.config.RateLimitCooldownMs) * time.Millisecond
+	if value := strings.TrimSpace(resp.Header.Get("Retry-After")); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			delay = time.Duration(seconds * float64(time.Second))
+		} else if at, err := http.ParseTime(value); err == nil {
+			delay = time.Until(at)
+		}
+	}
+
+	if delay < minRetryAfterDelay {
+		delay = minRetryAfterDelay
+	}
+	if delay > maxRetryAfterDelay {
+		delay = maxRetryAfterDelay
+	}
+	return delay
+}